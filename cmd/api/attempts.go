@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// attempt is a key whose failed attempts are limited by the policy. The
+// owner of email, if any, is told when the key gets locked.
+type attempt struct {
+	key    string
+	policy extended.AttemptPolicy
+	email  string
+}
+
+// Sign-ins are limited per email address, whether or not it belongs to a
+// user so the limits do not tell which do, and per IP address, with a higher
+// threshold since many users may share one.
+func (app *application) signInAttempts(r *http.Request, email string) (account, ip attempt) {
+	account = attempt{
+		key:   "email:" + strings.ToLower(email),
+		email: email,
+		policy: extended.AttemptPolicy{
+			Delay:     3,
+			MaxDelay:  time.Minute,
+			Threshold: app.config.auth.lockoutThreshold,
+			Lockout:   app.config.auth.lockoutDuration,
+			Window:    app.config.auth.lockoutDuration,
+		},
+	}
+	ip = attempt{
+		key: "ip:" + app.clientIP(r),
+		policy: extended.AttemptPolicy{
+			Delay:     app.config.auth.ipLockoutThreshold / 5,
+			MaxDelay:  time.Minute,
+			Threshold: app.config.auth.ipLockoutThreshold,
+			Lockout:   app.config.auth.lockoutDuration,
+			Window:    app.config.auth.lockoutDuration,
+		},
+	}
+	return account, ip
+}
+
+// Password reset requests are limited per email address, so a mailbox
+// cannot be flooded, and per IP address. Every request counts.
+func (app *application) passwordResetAttempts(r *http.Request, email string) (account, ip attempt) {
+	account = attempt{
+		key: "password-reset:email:" + strings.ToLower(email),
+		policy: extended.AttemptPolicy{
+			Delay:     1,
+			MaxDelay:  time.Minute,
+			Threshold: 5,
+			Lockout:   app.config.auth.lockoutDuration,
+			Window:    app.config.auth.lockoutDuration,
+		},
+	}
+	ip = attempt{
+		key: "password-reset:ip:" + app.clientIP(r),
+		policy: extended.AttemptPolicy{
+			Delay:     10,
+			MaxDelay:  time.Minute,
+			Threshold: 30,
+			Lockout:   app.config.auth.lockoutDuration,
+			Window:    app.config.auth.lockoutDuration,
+		},
+	}
+	return account, ip
+}
+
+// ipSignInAttempt returns the attempts of sign-ins whose account is not known
+// yet.
+func (app *application) ipSignInAttempt(r *http.Request) attempt {
+	_, ip := app.signInAttempts(r, "")
+	return ip
+}
+
+// reserveAttempts counts an attempt against each key before the credentials
+// are checked, so concurrent requests cannot get past the policies. When a
+// key must wait, it takes back the attempts it counted, writes a 429 response
+// and returns false.
+func (app *application) reserveAttempts(w http.ResponseWriter, r *http.Request, attempts ...attempt) bool {
+	for i, a := range attempts {
+		wait, locked, err := app.extended.Attempts.Reserve(a.key, a.policy)
+		if err == nil && wait == 0 {
+			continue
+		}
+
+		app.releaseAttempts(r, attempts[:i]...)
+
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+
+		if locked {
+			app.lockedOut(r, a)
+		}
+
+		app.tooManyAttemptsResponse(w, r, wait)
+		return false
+	}
+
+	return true
+}
+
+// releaseAttempts takes back the reserved attempts of credentials that
+// turned out to be right.
+func (app *application) releaseAttempts(r *http.Request, attempts ...attempt) {
+	for _, a := range attempts {
+		err := app.extended.Attempts.Release(a.key)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// confirmPassword checks the password a signed-in user entered to confirm a
+// sensitive change. Wrong passwords count against the account like failed
+// sign-ins. It writes the error response and returns false unless it
+// matches.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	account, ip := app.signInAttempts(r, user.Email)
+	if !app.reserveAttempts(w, r, account, ip) {
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+
+	app.releaseAttempts(r, account, ip)
+
+	return true
+}
+
+// lockedOut logs that the key got locked, and lets the owner of the account
+// know.
+func (app *application) lockedOut(r *http.Request, a attempt) {
+	app.logger.Warn("attempts locked out", "key", a.key, "duration", a.policy.Lockout)
+
+	if a.email == "" {
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(a.email)
+	if err != nil {
+		if !errors.Is(err, models.ErrRecordNotFound) {
+			app.logError(r, err)
+		}
+		return
+	}
+
+	_, err = app.jobs.Enqueue(jobAccountLockedEmail, accountLockedEmailJob{
+		Email:       user.Email,
+		IP:          app.clientIP(r),
+		LockedUntil: time.Now().Add(a.policy.Lockout),
+	})
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// resetSignIn forgets the failed sign-ins with the email address. It must not
+// be called before every factor of the user was checked.
+func (app *application) resetSignIn(r *http.Request, email string) {
+	account, _ := app.signInAttempts(r, email)
+
+	err := app.extended.Attempts.Reset(account.key)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
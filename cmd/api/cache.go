@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+
+	"github.com/pistolricks/go-api-template/internal/cache"
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// caches hold the lookups made on every authenticated request. They are per
+// instance: a change made through another instance is only seen here once
+// the entry expires, so their TTL is kept short.
+type caches struct {
+	// tokens maps the hash of an authentication token to its user.
+	tokens      *cache.LRU[[sha256.Size]byte, *models.User]
+	permissions *cache.LRU[int64, models.Permissions]
+}
+
+func newCaches(cfg config) caches {
+	return caches{
+		tokens:      cache.New[[sha256.Size]byte, *models.User](cfg.cache.size, cfg.cache.ttl),
+		permissions: cache.New[int64, models.Permissions](cfg.cache.size, cfg.cache.ttl),
+	}
+}
+
+// userForToken returns the user of an authentication token. fresh reports
+// whether the user was read from the database rather than the cache.
+func (app *application) userForToken(token string) (user *models.User, fresh bool, err error) {
+	hash := sha256.Sum256([]byte(token))
+
+	if cached, ok := app.cache.tokens.Get(hash); ok {
+		// Copy the user, so handlers changing it do not change the cache.
+		user := *cached
+		return &user, false, nil
+	}
+
+	user, err = app.models.Users.GetForToken(models.ScopeAuthentication, token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cached := *user
+	app.cache.tokens.Set(hash, &cached)
+
+	return user, true, nil
+}
+
+// permissionsForUser returns the permissions granted to the user directly
+// and through their roles.
+func (app *application) permissionsForUser(userID int64) (models.Permissions, error) {
+	if permissions, ok := app.cache.permissions.Get(userID); ok {
+		return permissions, nil
+	}
+
+	permissions, err := app.extended.Roles.GetPermissionsForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.cache.permissions.Set(userID, permissions)
+
+	return permissions, nil
+}
+
+// invalidateUser drops the cached tokens of the user, after their account,
+// password or tokens changed.
+func (app *application) invalidateUser(userID int64) {
+	app.cache.tokens.DeleteFunc(func(_ [sha256.Size]byte, user *models.User) bool {
+		return user.ID == userID
+	})
+}
+
+// invalidatePermissions drops the cached permissions of the user, after
+// their roles or permissions changed.
+func (app *application) invalidatePermissions(userID int64) {
+	app.cache.permissions.Delete(userID)
+}
@@ -8,7 +8,10 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey  = contextKey("user")
+	tokenContextKey = contextKey("token")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *models.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -27,3 +30,17 @@ func (app *application) contextClearUser(r *http.Request) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, nil)
 	return r.WithContext(ctx)
 }
+
+// contextSetToken stores the authentication token the user was
+// authenticated with.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken returns the authentication token of the request, or ""
+// when the request was not authenticated with one.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
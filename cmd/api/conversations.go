@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/ws"
+	"github.com/pistolricks/validation"
+)
+
+// chatPolicy is the ws.Policy of the hub: direct messages are between a
+// customer and a vendor, so one of the users must run a vendor, and the only
+// rooms are the public rooms of the vendors, named vendor:<id>.
+type chatPolicy struct {
+	app *application
+}
+
+func (p chatPolicy) CanContact(userID, otherID int64) (bool, error) {
+	return p.app.extended.Vendors.RunByAny(userID, otherID)
+}
+
+func (p chatPolicy) CanJoin(userID int64, room string) (bool, error) {
+	id, ok := strings.CutPrefix(room, "vendor:")
+	if !ok {
+		return false, nil
+	}
+
+	vendorID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+
+	_, err = p.app.extended.Vendors.Get(vendorID)
+	if err != nil {
+		if errors.Is(err, extended.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (app *application) listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validation.New()
+
+	qs := r.URL.Query()
+
+	page := app.readInt(qs, "page", 1, v)
+	pageSize := app.readInt(qs, "page_size", 20, v)
+
+	v.Check(page > 0, "page", "must be greater than 0")
+	v.Check(page <= 10_000_000, "page", "must be a maximum 10 million")
+	v.Check(pageSize > 0, "page_size", "must be greater than 0")
+	v.Check(pageSize <= 100, "page_size", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	conversations, err := app.ws.Conversations.GetAllForUser(user.ID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"conversations": conversations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listConversationMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validation.New()
+
+	qs := r.URL.Query()
+
+	cursor := app.readInt(qs, "cursor", 0, v)
+	limit := app.readInt(qs, "limit", ws.DefaultHistoryLimit, v)
+
+	v.Check(cursor >= 0, "cursor", "must not be negative")
+	v.Check(limit > 0, "limit", "must be greater than 0")
+	v.Check(limit <= ws.MaxHistoryLimit, "limit", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	conversation, err := app.ws.Conversations.Get(id)
+	if err == nil && !conversation.Includes(user.ID) {
+		err = ws.ErrRecordNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	messages, err := app.ws.Messages.GetAfter("", conversation.ID, int64(cursor), limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	next := int64(cursor)
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].ID
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"conversation": conversation, "messages": messages, "cursor": next}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
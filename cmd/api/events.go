@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	iws "github.com/pistolricks/go-api-template/internal/ws"
+	"github.com/pistolricks/validation"
+)
+
+// eventsHandler streams the hub's notices to clients that cannot use
+// WebSockets as server-sent events. Clients resume with the Last-Event-ID
+// header, or the last_event_id query parameter, and may join rooms with a
+// comma separated rooms parameter.
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		var ok bool
+		if user, ok = app.queryTokenUser(w, r); !ok {
+			return
+		}
+	}
+
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	if app.chatBanned(w, r, user.ID) {
+		return
+	}
+
+	v := validation.New()
+	qs := r.URL.Query()
+
+	rooms := app.readCSV(qs, "rooms", []string{})
+	for _, room := range rooms {
+		iws.ValidateRoom(v, room)
+	}
+
+	var lastEventID int64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		v.Check(err == nil && id >= 0, "Last-Event-ID", "must be a positive integer")
+		lastEventID = id
+	} else {
+		lastEventID = int64(app.readInt(qs, "last_event_id", 0, v))
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	permissions, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !permissions.Include(iws.PermissionMessagesRead) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	// The hub checks the rooms too, but only once the stream has started.
+	for _, room := range rooms {
+		ok, err := (chatPolicy{app: app}).CanJoin(user.ID, room)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !ok {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	// The stream outlives the server's write timeout; each write sets its own
+	// deadline instead.
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, rc: rc, timeout: app.config.ws.ioTimeout, done: make(chan struct{})}
+	defer stream.Close()
+
+	agent, err := app.hub.Stream(stream, iws.Client{
+		UserID:      user.ID,
+		Name:        user.Name,
+		Permissions: permissions,
+	}, rooms, lastEventID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	select {
+	case <-stream.done:
+	case <-r.Context().Done():
+	}
+
+	app.hub.Remove(agent)
+}
+
+var errStreamClosed = errors.New("event stream closed")
+
+// eventStream writes server-sent events to the response. Writes fail once it
+// is closed, so the hub stops using the response when the handler returns.
+type eventStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+	closed  bool
+	done    chan struct{}
+}
+
+func (s *eventStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errStreamClosed
+	}
+
+	if err := s.rc.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return 0, err
+	}
+
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.rc.Flush()
+}
+
+func (s *eventStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+
+	return nil
+}
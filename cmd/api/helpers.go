@@ -10,8 +10,10 @@ import (
 	geojson "github.com/paulmach/go.geojson"
 	"github.com/pistolricks/validation"
 	"github.com/speps/go-hashids/v2"
+	"github.com/tomasen/realip"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -177,18 +179,18 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
-	go func() {
-		defer app.wg.Done()
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.Error(fmt.Sprintf("%v", err))
-			}
-		}()
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validation.Validator) float64 {
 
-		fn()
-	}()
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+	return f
 }
 
 func HashID(id int64) string {
@@ -244,3 +246,22 @@ func (app *application) handleDecodeHashids(id string, salt string) int64 {
 
 	return int64(d[0])
 }
+
+// clientIP returns the IP address of the client. The X-Forwarded-For and
+// X-Real-IP headers are only believed when set by a trusted proxy, since
+// clients can send any value.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	for _, proxy := range app.config.auth.trustedProxies {
+		if ip != nil && proxy.Contains(ip) {
+			return realip.FromRequest(r)
+		}
+	}
+
+	return host
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"time"
+
+	sm "github.com/flopp/go-staticmaps"
+	"github.com/fogleman/gg"
+	"github.com/golang/geo/s2"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/jobs"
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// Kinds of the background jobs run by the queue.
+const (
+	jobWelcomeEmail       = "welcome_email"
+	jobActivationEmail    = "activation_email"
+	jobPasswordResetEmail = "password_reset_email"
+	jobPositionMap        = "position_map"
+	jobPhoneCode          = "phone_code"
+	jobAccountLockedEmail = "account_locked_email"
+	jobPruneEvents        = "prune_events"
+	jobEmailChangeEmail   = "email_change_email"
+)
+
+// pruneEventsInterval is how often the hub events too old to be replayed are
+// deleted.
+const pruneEventsInterval = time.Hour
+
+// Lifetimes of the tokens sent by email.
+const (
+	activationTTL    = 3 * 24 * time.Hour
+	passwordResetTTL = 45 * time.Minute
+	emailChangeTTL   = 24 * time.Hour
+)
+
+// The email jobs only carry the user: their tokens are created when the
+// email is sent, so no plaintext token is ever stored in the jobs table.
+
+type welcomeEmailJob struct {
+	Email  string `json:"email"`
+	UserID int64  `json:"user_id"`
+}
+
+type activationEmailJob struct {
+	Email  string `json:"email"`
+	UserID int64  `json:"user_id"`
+}
+
+type passwordResetEmailJob struct {
+	Email  string `json:"email"`
+	UserID int64  `json:"user_id"`
+}
+
+type emailChangeEmailJob struct {
+	Email  string `json:"email"`
+	UserID int64  `json:"user_id"`
+}
+
+type accountLockedEmailJob struct {
+	Email       string    `json:"email"`
+	IP          string    `json:"ip"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type pruneEventsJob struct{}
+
+// phoneCodeJob sends the code started for the user; like the email tokens,
+// it is created when the SMS is sent.
+type phoneCodeJob struct {
+	UserID  int64  `json:"user_id"`
+	Purpose string `json:"purpose"`
+}
+
+type positionMapJob struct {
+	UserID   int64   `json:"user_id"`
+	Title    string  `json:"title"`
+	Filename string  `json:"filename"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+}
+
+// jobQueue creates the background job queue on the worker pool and
+// registers the job handlers.
+func (app *application) jobQueue(db *sql.DB) {
+	app.jobs = jobs.New(db, app.pool, app.logger, jobs.Config{
+		Concurrency:  app.config.jobs.concurrency,
+		PollInterval: app.config.jobs.pollInterval,
+		Lease:        app.config.jobs.lease,
+		MaxAttempts:  app.config.jobs.maxAttempts,
+		Backoff:      app.config.jobs.backoff,
+		Retention:    app.config.jobs.retention,
+	})
+
+	jobs.Register(app.jobs, jobWelcomeEmail, app.sendWelcomeEmail)
+	jobs.Register(app.jobs, jobActivationEmail, app.sendActivationEmail)
+	jobs.Register(app.jobs, jobPasswordResetEmail, app.sendPasswordResetEmail)
+	jobs.Register(app.jobs, jobPositionMap, app.renderPositionMap)
+	jobs.Register(app.jobs, jobPhoneCode, app.sendPhoneCode)
+	jobs.Register(app.jobs, jobAccountLockedEmail, app.sendAccountLockedEmail)
+	jobs.Register(app.jobs, jobPruneEvents, app.pruneEvents)
+	jobs.Register(app.jobs, jobEmailChangeEmail, app.sendEmailChangeEmail)
+
+	app.jobs.Every(jobPruneEvents, pruneEventsInterval, pruneEventsJob{})
+}
+
+func (app *application) sendWelcomeEmail(ctx context.Context, p *welcomeEmailJob) error {
+	token, err := app.models.Tokens.New(p.UserID, activationTTL, models.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+		"userID":          p.UserID,
+	}
+
+	return app.mailer.Send(p.Email, "user_welcome.tmpl", data)
+}
+
+func (app *application) sendActivationEmail(ctx context.Context, p *activationEmailJob) error {
+	token, err := app.models.Tokens.New(p.UserID, activationTTL, models.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+	}
+
+	return app.mailer.Send(p.Email, "token_activation.tmpl", data)
+}
+
+func (app *application) sendPasswordResetEmail(ctx context.Context, p *passwordResetEmailJob) error {
+	token, err := app.models.Tokens.New(p.UserID, passwordResetTTL, models.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"passwordResetToken": token.Plaintext,
+	}
+
+	return app.mailer.Send(p.Email, "token_password_reset.tmpl", data)
+}
+
+func (app *application) sendEmailChangeEmail(ctx context.Context, p *emailChangeEmailJob) error {
+	token, err := app.models.Tokens.New(p.UserID, emailChangeTTL, extended.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"emailChangeToken": token.Plaintext,
+	}
+
+	return app.notify.Send(p.Email, "email_change.tmpl", data)
+}
+
+func (app *application) sendAccountLockedEmail(ctx context.Context, p *accountLockedEmailJob) error {
+	data := map[string]any{
+		"ip":          p.IP,
+		"lockedUntil": p.LockedUntil.UTC().Format(time.RFC1123),
+	}
+
+	return app.notify.Send(p.Email, "account_locked.tmpl", data)
+}
+
+// pruneEvents deletes the hub events streams can no longer resume from.
+func (app *application) pruneEvents(ctx context.Context, p *pruneEventsJob) error {
+	n, err := app.ws.Events.Prune()
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		app.logger.Info("events pruned", "count", n)
+	}
+
+	return nil
+}
+
+func (app *application) sendPhoneCode(ctx context.Context, p *phoneCodeJob) error {
+	code, phone, err := app.extended.PhoneCodes.Issue(p.UserID, p.Purpose)
+	if err != nil {
+		// The code expired before it could be sent.
+		if errors.Is(err, extended.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return app.sms.Send(phone, fmt.Sprintf("Your code is %s. It expires in %d minutes.", code, int(extended.CodeTTL.Minutes())))
+}
+
+// renderPositionMap renders a map with a marker at the position, stores it
+// under the user's static folder named after its hash and records it as a
+// content of the user.
+func (app *application) renderPositionMap(ctx context.Context, p *positionMapJob) error {
+	folder := app.handleEncodeHashids(p.UserID, "Ollivr")
+
+	pathway := filepath.Join("ui/static", folder)
+
+	err := os.MkdirAll(pathway, 0755)
+	if err != nil {
+		return err
+	}
+
+	mc := sm.NewContext()
+	mc.SetSize(600, 400)
+	mc.SetZoom(14)
+
+	mc.OverrideAttribution(p.Title)
+	mc.AddObject(
+		sm.NewMarker(
+			s2.LatLngFromDegrees(p.Lat, p.Lng),
+			color.RGBA{0xff, 0, 0, 0xff},
+			16.0,
+		),
+	)
+
+	img, err := mc.Render()
+	if err != nil {
+		return err
+	}
+
+	f := filepath.Join(pathway, fmt.Sprintf("%s.png", p.Filename))
+	if err := gg.SavePNG(f, img); err != nil {
+		return err
+	}
+
+	hash := extended.HashImage(f)
+	hashedFileName := fmt.Sprintf("%s.png", hash)
+
+	hfp := filepath.Join(pathway, hashedFileName)
+
+	err = app.handleRenameFile(f, hfp)
+	if err != nil {
+		return err
+	}
+
+	content := &extended.Content{
+		Name:     hashedFileName,
+		Original: p.Filename,
+		Hash:     hash,
+		Src:      hfp,
+		Type:     "image/png",
+		Size:     600,
+		Folder:   folder,
+		UserID:   p.UserID,
+	}
+
+	err = app.extended.Contents.Insert(content)
+	if err != nil && !errors.Is(err, extended.ErrDuplicateHash) {
+		return err
+	}
+
+	// A duplicate hash means the same map was already stored, e.g. by an
+	// earlier attempt of this job.
+	return nil
+}
@@ -7,15 +7,23 @@ import (
 	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
+	"github.com/mailru/easygo/netpoll"
+	"github.com/pistolricks/go-api-template/internal/api/routing"
+	"github.com/pistolricks/go-api-template/internal/cache"
 	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/jobs"
+	"github.com/pistolricks/go-api-template/internal/notify"
+	"github.com/pistolricks/go-api-template/internal/oauth"
+	gopool "github.com/pistolricks/go-api-template/internal/pool"
+	"github.com/pistolricks/go-api-template/internal/sms"
 	"github.com/pistolricks/go-api-template/internal/ws"
 	"github.com/pistolricks/mailer"
 	"github.com/pistolricks/models/cmd/models"
 	"log/slog"
+	"net"
 	"os"
 	"runtime"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -39,6 +47,20 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	auth struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+		totpIssuer string
+
+		lockoutThreshold   int
+		ipLockoutThreshold int
+		lockoutDuration    time.Duration
+		trustedProxies     []*net.IPNet
+	}
+	cache struct {
+		size int
+		ttl  time.Duration
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -47,11 +69,37 @@ type config struct {
 		sender   string
 	}
 	ws struct {
-		addr      string
-		debug     string
-		workers   int
-		queue     int
-		ioTimeout time.Duration
+		debug            string
+		workers          int
+		queue            int
+		ioTimeout        time.Duration
+		backplane        string
+		channel          string
+		pingInterval     time.Duration
+		pongTimeout      time.Duration
+		presenceInterval time.Duration
+		presenceTTL      time.Duration
+		sendQueue        int
+		slowPolicy       string
+		rateLimit        float64
+		rateBurst        int
+		filterWords      []string
+		blockLinks       bool
+	}
+	sms struct {
+		sender string
+		file   string
+	}
+	oauth struct {
+		providers string
+	}
+	jobs struct {
+		concurrency  int
+		pollInterval time.Duration
+		lease        time.Duration
+		maxAttempts  int
+		backoff      time.Duration
+		retention    time.Duration
 	}
 	proxy struct {
 		addr        string
@@ -60,16 +108,30 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	routing struct {
+		provider string
+		osrmURL  string
+		speed    float64
+	}
 }
 
 type application struct {
-	config   config
-	logger   *slog.Logger
-	models   models.Models
-	extended extended.Extended
-	mailer   mailer.Mailer
-	wg       sync.WaitGroup
-	ws       ws.Ws
+	config    config
+	logger    *slog.Logger
+	models    models.Models
+	extended  extended.Extended
+	mailer    mailer.Mailer
+	notify    notify.Mailer
+	sms       sms.Sender
+	cache     caches
+	oauth     map[string]*oauth.Provider
+	ws        ws.Ws
+	hub       *ws.Message
+	pool      *gopool.Pool
+	jobs      *jobs.Queue
+	poller    netpoll.Poller
+	backplane ws.Backplane
+	routing   routing.Provider
 }
 
 func main() {
@@ -87,22 +149,82 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
+	flag.DurationVar(&cfg.auth.accessTTL, "auth-access-ttl", 15*time.Minute, "Authentication (access) token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTTL, "auth-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.IntVar(&cfg.auth.lockoutThreshold, "auth-lockout-threshold", 10, "Failed sign-ins with an email address before it is locked out")
+	flag.IntVar(&cfg.auth.ipLockoutThreshold, "auth-ip-lockout-threshold", 100, "Failed sign-ins from an IP address before it is locked out")
+	flag.DurationVar(&cfg.auth.lockoutDuration, "auth-lockout-duration", 15*time.Minute, "Sign-in lockout duration, and how long failed sign-ins are remembered")
+	flag.Func("auth-trusted-proxies", "Proxies trusted to set X-Forwarded-For and X-Real-IP (space separated IPs or CIDRs)", func(val string) error {
+		for _, s := range strings.Fields(val) {
+			if !strings.Contains(s, "/") {
+				ip := net.ParseIP(s)
+				if ip == nil {
+					return fmt.Errorf("invalid proxy %q", s)
+				}
+				s = ip.String() + "/128"
+				if ip.To4() != nil {
+					s = ip.String() + "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return err
+			}
+			cfg.auth.trustedProxies = append(cfg.auth.trustedProxies, ipNet)
+		}
+		return nil
+	})
+	flag.StringVar(&cfg.auth.totpIssuer, "auth-totp-issuer", "Ollivr", "Issuer shown by authenticator apps for two-factor authentication")
+
+	flag.IntVar(&cfg.cache.size, "cache-size", 10000, "Cached authentication tokens and user permissions, each")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "Cached authentication token and user permissions lifetime")
+
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "TEAM <no-reply@team.ollivr.com>", "SMTP sender")
 
-	flag.StringVar(&cfg.ws.addr, "listen", ":4000", "WS address to bind to")
 	flag.StringVar(&cfg.ws.debug, "pprof", "", "WS address for pprof http")
 
-	flag.IntVar(&cfg.ws.workers, "workers", 128, "WS max workers count")
-	flag.IntVar(&cfg.ws.queue, "queue", 1, "WS workers task queue size")
+	flag.IntVar(&cfg.ws.workers, "workers", 128, "Worker pool max workers count")
+	flag.IntVar(&cfg.ws.queue, "queue", 1, "Worker pool task queue size")
 	flag.DurationVar(&cfg.ws.ioTimeout, "io_timeout", 100*time.Millisecond, "WS i/o operations timeout")
+	flag.StringVar(&cfg.ws.backplane, "ws-backplane", "memory", "WS backplane shared by API instances (memory|postgres)")
+	flag.StringVar(&cfg.ws.channel, "ws-backplane-channel", "ws_backplane", "WS Postgres backplane LISTEN/NOTIFY channel")
+	flag.DurationVar(&cfg.ws.pingInterval, "ws-ping-interval", 30*time.Second, "WS ping interval (0 disables pings)")
+	flag.DurationVar(&cfg.ws.pongTimeout, "ws-pong-timeout", 75*time.Second, "WS time without a pong before a connection is evicted")
+	flag.DurationVar(&cfg.ws.presenceInterval, "ws-presence-interval", 30*time.Second, "WS interval at which an instance announces the presence of its users")
+	flag.DurationVar(&cfg.ws.presenceTTL, "ws-presence-ttl", 90*time.Second, "WS time without an announcement before an instance's users are considered offline")
+	flag.IntVar(&cfg.ws.sendQueue, "ws-send-queue", 64, "WS outbound messages buffered per connection")
+	flag.StringVar(&cfg.ws.slowPolicy, "ws-slow-policy", ws.SlowDrop, "WS policy for connections with a full send queue (drop|disconnect)")
+	flag.Float64Var(&cfg.ws.rateLimit, "ws-rate-limit", 1, "WS messages per second a user may send (0 disables the limit)")
+	flag.IntVar(&cfg.ws.rateBurst, "ws-rate-burst", 5, "WS message burst a user may send")
+	flag.Func("ws-filter-words", "WS words rejected in messages and names (space separated)", func(val string) error {
+		cfg.ws.filterWords = strings.Fields(val)
+		return nil
+	})
+	flag.BoolVar(&cfg.ws.blockLinks, "ws-block-links", false, "WS reject messages and names containing links")
+
+	flag.StringVar(&cfg.sms.sender, "sms-sender", "log", "SMS sender (log|file)")
+	flag.StringVar(&cfg.sms.file, "sms-file", "sms.log", "File the file SMS sender appends messages to")
+
+	flag.StringVar(&cfg.oauth.providers, "oauth-providers", "", "JSON file of the OAuth2/OpenID Connect providers users can sign in with")
+
+	flag.IntVar(&cfg.jobs.concurrency, "jobs-concurrency", 8, "Background jobs run at once")
+	flag.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", 5*time.Second, "Background jobs queue poll interval")
+	flag.DurationVar(&cfg.jobs.lease, "jobs-lease", 5*time.Minute, "Background job run time before another instance may retry it")
+	flag.IntVar(&cfg.jobs.maxAttempts, "jobs-max-attempts", 5, "Background job attempts before it is dead-lettered")
+	flag.DurationVar(&cfg.jobs.backoff, "jobs-backoff", 30*time.Second, "Background job delay before the first retry, doubled on every attempt")
+	flag.DurationVar(&cfg.jobs.retention, "jobs-retention", 7*24*time.Hour, "Dead-lettered background job retention (0 keeps them)")
 
 	flag.StringVar(&cfg.proxy.addr, "addr", ":8888", "port to listen")
 	flag.StringVar(&cfg.proxy.messageAddr, "messageAddr", "localhost:4000", "message tcp addr to proxy pass")
 
+	flag.StringVar(&cfg.routing.provider, "routing-provider", "straight", "Routing provider (straight|osrm)")
+	flag.StringVar(&cfg.routing.osrmURL, "routing-osrm-url", routing.DefaultOSRMURL, "OSRM-compatible routing service URL")
+	flag.Float64Var(&cfg.routing.speed, "routing-speed", routing.DefaultSpeed, "Straight-line routing average speed in km/h")
+
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
@@ -150,20 +272,78 @@ func main() {
 		return time.Now().Unix()
 	}))
 
+	backplane, err := openBackplane(cfg, db)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	defer func(backplane ws.Backplane) {
+		err := backplane.Close()
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}(backplane)
+
 	app := &application{
-		config:   cfg,
-		logger:   logger,
-		models:   models.NewModels(db),
-		extended: extended.NewExtended(db),
-		ws:       ws.NewWs(db),
-		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:    cfg,
+		logger:    logger,
+		models:    models.NewModels(db),
+		extended:  extended.NewExtended(db),
+		cache:     newCaches(cfg),
+		ws:        ws.NewWs(db),
+		backplane: backplane,
+		mailer:    mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		notify:    notify.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
 	}
 
+	app.routing = app.newRoutingProvider()
+
+	app.sms, err = app.newSMSSender()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	err = app.loadOAuthProviders()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Make pool of X size, Y sized work queue and one pre-spawned
+	// goroutine, shared by the WebSocket connections and background jobs.
+	app.pool = gopool.NewPool(cfg.ws.workers, cfg.ws.queue, 1)
+	app.pool.OnPanic = func(err *gopool.PanicError) {
+		logger.Error(err.Error(), "stack", string(err.Stack))
+	}
+
+	app.jobQueue(db)
+
 	err = app.websockets()
 	if err != nil {
 		logger.Error(err.Error())
+		os.Exit(1)
 	}
 
+	// Publish the WebSocket hub counters.
+	expvar.Publish("websockets", expvar.Func(func() any {
+		return app.hub.Stats()
+	}))
+
+	// Publish the authentication cache counters.
+	expvar.Publish("cache", expvar.Func(func() any {
+		return map[string]cache.Stats{
+			"tokens":      app.cache.tokens.Stats(),
+			"permissions": app.cache.permissions.Stats(),
+		}
+	}))
+
+	// Publish the worker pool counters.
+	expvar.Publish("pool", expvar.Func(func() any {
+		return app.pool.Stats()
+	}))
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -172,6 +352,17 @@ func main() {
 
 }
 
+func openBackplane(cfg config, db *sql.DB) (ws.Backplane, error) {
+	switch cfg.ws.backplane {
+	case "memory":
+		return ws.NewMemoryBackplane(), nil
+	case "postgres":
+		return ws.NewPostgresBackplane(db, cfg.db.dsn, cfg.ws.channel)
+	default:
+		return nil, fmt.Errorf("unknown ws backplane %q", cfg.ws.backplane)
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -1,18 +1,16 @@
 package main
 
 import (
-	"fmt"
-	sm "github.com/flopp/go-staticmaps"
-	"github.com/fogleman/gg"
-	"github.com/golang/geo/s2"
-	"github.com/pistolricks/go-api-template/internal/extended"
 	"github.com/pistolricks/validation"
-	"image/color"
 	"net/http"
 	"path/filepath"
 	"strconv"
 )
 
+// positionMapHandler queues the rendering of a map of the position; the
+// image is added to the user's contents once rendered. Its name is the hash
+// of the image, which is not known yet, so the response only has the job:
+// clients find the map with GET /v1/contents?original=<filename>.
 func (app *application) positionMapHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct {
@@ -28,86 +26,39 @@ func (app *application) positionMapHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	v := validation.New()
+
 	lat64, err := strconv.ParseFloat(input.Lat, 64)
+	v.Check(err == nil, "lat", "must be a number")
 	lng64, err := strconv.ParseFloat(input.Lng, 64)
+	v.Check(err == nil, "lng", "must be a number")
 
-	geo := &extended.Geo{
-		Title:    input.Title,
-		Filename: input.Filename,
-		Lat:      lat64,
-		Lng:      lng64,
-	}
-	/*
-		app.background(func() {
-			extended.PositionMap(geo)
-		})
-	*/
-	user := app.contextGetUser(r)
-	folder := app.handleEncodeHashids(user.ID, "Ollivr")
-
-	pathway := filepath.Join("ui/static", folder)
-
-	// var filename = filepath.Base(geo.Filename)
-	var filename = geo.Filename
-	ctx := sm.NewContext()
-	ctx.SetSize(600, 400)
-	ctx.SetZoom(14)
-
-	ctx.OverrideAttribution(geo.Title)
-	ctx.AddObject(
-		sm.NewMarker(
-			s2.LatLngFromDegrees(geo.Lat, geo.Lng),
-			color.RGBA{0xff, 0, 0, 0xff},
-			16.0,
-		),
-	)
-
-	img, err := ctx.Render()
-	if err != nil {
-		panic(err)
-	}
-
-	fileTitle := fmt.Sprintf("%s.png", filename)
-	f := filepath.Join(pathway, fileTitle)
-	if err := gg.SavePNG(f, img); err != nil {
-		panic(err)
-	}
-
-	hash := extended.HashImage(f)
-	hashedFileName := fmt.Sprintf("%s.png", hash)
+	v.Check(input.Title != "", "title", "must be provided")
+	v.Check(input.Filename != "", "filename", "must be provided")
+	v.Check(input.Filename == filepath.Base(input.Filename), "filename", "must not contain a path")
 
-	hfp := filepath.Join(pathway, hashedFileName)
-
-	herr := app.handleRenameFile(f, hfp)
-	if herr != nil {
-		app.badRequestResponse(w, r, herr)
-	}
-
-	content := &extended.Content{
-		Name:     hashedFileName,
-		Original: geo.Filename,
-		Hash:     hash,
-		Src:      hfp,
-		Type:     "image/png",
-		Size:     600,
-		Folder:   folder,
-		UserID:   user.ID,
-	}
-
-	v := validation.New()
-
-	if extended.ValidateContent(v, content); !v.Valid() {
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.extended.Contents.Insert(content)
+	user := app.contextGetUser(r)
+
+	job, err := app.jobs.Enqueue(jobPositionMap, positionMapJob{
+		UserID:   user.ID,
+		Title:    input.Title,
+		Filename: input.Filename,
+		Lat:      lat64,
+		Lng:      lng64,
+	})
 	if err != nil {
-		app.duplicateErrorResponse(w, r, err)
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"userId": user.ID, "folder": folder, "path": pathway, "type": r.FormValue("type"), "size": 600, "hash": hash}, nil)
+	folder := app.handleEncodeHashids(user.ID, "Ollivr")
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"userId": user.ID, "folder": folder, "job": job, "message": "the map will be added to your contents once rendered"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
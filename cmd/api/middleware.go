@@ -104,7 +104,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(models.ScopeAuthentication, token)
+		user, fresh, err := app.userForToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, models.ErrRecordNotFound):
@@ -115,7 +115,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Touch is throttled to once a minute anyway, so it is skipped while
+		// the token is cached.
+		if fresh {
+			err = app.extended.Sessions.Touch(token, app.clientIP(r), r.UserAgent())
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -146,7 +156,7 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.permissionsForUser(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pistolricks/go-api-template/internal/ws"
+	"github.com/pistolricks/validation"
+)
+
+// chatFilter builds the content filter applied by the hub from the
+// configuration, or returns nil when nothing is filtered.
+func (app *application) chatFilter() ws.Filter {
+	var filters ws.Filters
+
+	if len(app.config.ws.filterWords) > 0 {
+		filters = append(filters, ws.NewWordList(app.config.ws.filterWords))
+	}
+	if app.config.ws.blockLinks {
+		filters = append(filters, ws.LinkBlocker{})
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	return filters
+}
+
+// chatBanned writes a 403 response and reports true when the user is banned
+// from chat.
+func (app *application) chatBanned(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	ban, err := app.ws.Bans.GetActive(userID)
+	if err != nil {
+		if errors.Is(err, ws.ErrRecordNotFound) {
+			return false
+		}
+		app.serverErrorResponse(w, r, err)
+		return true
+	}
+
+	err = app.writeJSON(w, http.StatusForbidden, envelope{"error": "you are banned from chat", "ban": ban}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	return true
+}
+
+func (app *application) listReportsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validation.New()
+
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", ws.ReportOpen)
+	page := app.readInt(qs, "page", 1, v)
+	pageSize := app.readInt(qs, "page_size", 20, v)
+
+	ws.ValidateReportStatus(v, status)
+	v.Check(page > 0, "page", "must be greater than 0")
+	v.Check(page <= 10_000_000, "page", "must be a maximum 10 million")
+	v.Check(pageSize > 0, "page_size", "must be greater than 0")
+	v.Check(pageSize <= 100, "page_size", "must be a maximum of 100")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reports, err := app.ws.Reports.GetAll(status, pageSize, (page-1)*pageSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reports": reports}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Status string `json:"status"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if ws.ValidateReportStatus(v, input.Status); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	report, err := app.ws.Reports.SetStatus(id, input.Status, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// banUserHandler bans the user in the URL from chat, for the given duration
+// or for good, and disconnects their open connections.
+func (app *application) banUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Reason    string     `json:"reason"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	ban := &ws.Ban{
+		UserID:    id,
+		BannedBy:  user.ID,
+		Reason:    input.Reason,
+		ExpiresAt: input.ExpiresAt,
+	}
+
+	v := validation.New()
+
+	if ws.ValidateBan(v, ban); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.ws.Bans.Upsert(ban)
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.hub.Kick(id, ban.Reason)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"ban": ban}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.ws.Bans.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ban successfully lifted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
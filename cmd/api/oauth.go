@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/oauth"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+)
+
+// errLinkRequired is returned when an identity matches an existing user by
+// email, but only the user may link it, from their profile.
+var errLinkRequired = errors.New("identity must be linked by the user")
+
+// loadOAuthProviders reads the identity providers users can sign in with.
+func (app *application) loadOAuthProviders() error {
+	app.oauth = map[string]*oauth.Provider{}
+
+	if app.config.oauth.providers == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	providers, err := oauth.Load(ctx, app.config.oauth.providers)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range providers {
+		p.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	app.oauth = providers
+
+	return nil
+}
+
+// readProviderParam returns the identity provider in the URL.
+func (app *application) readProviderParam(r *http.Request) (*oauth.Provider, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+
+	provider, ok := app.oauth[name]
+	return provider, ok
+}
+
+func (app *application) listOAuthProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := make([]string, 0, len(app.oauth))
+	for name := range app.oauth {
+		providers = append(providers, name)
+	}
+	slices.Sort(providers)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"providers": providers}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createOAuthAuthorizationHandler starts a sign-in with the provider in the
+// URL. The client sends the user to the returned URL, and keeps the state to
+// check it against the one the provider redirects back with.
+func (app *application) createOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	app.authorize(w, r, 0)
+}
+
+// createIdentityAuthorizationHandler starts linking an account at the
+// provider in the URL to the user.
+func (app *application) createIdentityAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	app.authorize(w, r, app.contextGetUser(r).ID)
+}
+
+func (app *application) authorize(w http.ResponseWriter, r *http.Request, userID int64) {
+	provider, ok := app.readProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	verifier, err := oauth.NewVerifier()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	state, err := app.extended.OAuthStates.New(provider.Name, userID, verifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization_url": provider.AuthCodeURL(state, verifier), "state": state}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readIdentity reads the code and state the provider redirected back with,
+// and returns the identity of the user at the provider. The request counts as
+// a failed sign-in from the IP address until the caller releases it.
+func (app *application) readIdentity(w http.ResponseWriter, r *http.Request, userID int64) (*oauth.Identity, bool) {
+	provider, ok := app.readProviderParam(r)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validation.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	if !app.reserveAttempts(w, r, app.ipSignInAttempt(r)) {
+		return nil, false
+	}
+
+	verifier, err := app.extended.OAuthStates.Consume(input.State, provider.Name, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidState):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	accessToken, err := provider.Exchange(r.Context(), input.Code, verifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrInvalidGrant):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	identity, err := provider.UserInfo(r.Context(), accessToken)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	return identity, true
+}
+
+// createOAuthAuthenticationTokenHandler signs a user in with an identity
+// provider. An identity not linked yet is linked to the user with the same
+// email, or to a new user, provided the provider verified the email.
+func (app *application) createOAuthAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	identity, ok := app.readIdentity(w, r, 0)
+	if !ok {
+		return
+	}
+
+	var user *models.User
+
+	userID, err := app.extended.Identities.GetUserID(identity.Provider, identity.Subject)
+	switch {
+	case err == nil:
+		user, err = app.userForID(userID)
+	case errors.Is(err, extended.ErrRecordNotFound):
+		if !identity.EmailVerified {
+			app.releaseAttempts(r, app.ipSignInAttempt(r))
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "the provider did not share a verified email address, sign in another way and link the account from your profile")
+			return
+		}
+		user, err = app.linkIdentity(identity)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound), errors.Is(err, models.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, errLinkRequired):
+			app.releaseAttempts(r, app.ipSignInAttempt(r))
+			app.errorResponse(w, r, http.StatusConflict, "a user with this email address already exists, sign in another way and link the account from your profile")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.releaseAttempts(r, app.ipSignInAttempt(r))
+
+	app.signIn(w, r, user)
+}
+
+// userForID returns the user with the ID, unless they were deleted.
+func (app *application) userForID(id int64) (*models.User, error) {
+	profile, err := app.extended.Profiles.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.models.Users.GetByEmail(profile.Email)
+}
+
+// linkIdentity links the identity to the user with its verified email, or to
+// a new user when there is none. The email only proves the identity is the
+// existing user's when the provider itself stated it verified it; otherwise
+// errLinkRequired is returned. A user who never activated their account is
+// reclaimed for the identity first.
+func (app *application) linkIdentity(identity *oauth.Identity) (*models.User, error) {
+	user, err := app.models.Users.GetByEmail(identity.Email)
+	switch {
+	case err == nil:
+		if !identity.EmailClaimed {
+			return nil, errLinkRequired
+		}
+
+		user, err = app.userForID(user.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !user.Activated {
+			user, err = app.reclaimUser(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, models.ErrRecordNotFound):
+		user, err = app.registerIdentity(identity)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.extended.Identities.Insert(&extended.Identity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		UserID:   user.ID,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// reclaimUser hands an account that was never activated over to the owner of
+// its email address, who just proved it with the provider. Anyone could have
+// registered the address before them, so the password is replaced with a
+// random one and everything set up on the account so far is discarded.
+// Accounts that were activated once are left alone, with errLinkRequired.
+func (app *application) reclaimUser(user *models.User) (*models.User, error) {
+	reclaimable, err := app.extended.Profiles.Reclaimable(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reclaimable {
+		return nil, errLinkRequired
+	}
+
+	password, err := oauth.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.extended.Profiles.Reclaim(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.invalidateUser(user.ID)
+
+	err = app.hub.Kick(user.ID, "account reclaimed")
+	if err != nil {
+		return nil, err
+	}
+
+	return app.userForID(user.ID)
+}
+
+// registerIdentity creates an activated user for the identity. The user has
+// a random password, which they can reset to sign in with their email.
+func (app *application) registerIdentity(identity *oauth.Identity) (*models.User, error) {
+	name := identity.Name
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	user := &models.User{
+		Name:      name,
+		Email:     identity.Email,
+		Activated: true,
+	}
+
+	password, err := oauth.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validation.New()
+	if models.ValidateUser(v, user); !v.Valid() {
+		return nil, fmt.Errorf("invalid identity: %v", v.Errors)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.extended.Roles.AddForUser(user.ID, extended.RoleCustomer, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// linkIdentityHandler links the account at the provider in the URL to the
+// user, so they can sign in with it.
+func (app *application) linkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	identity, ok := app.readIdentity(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	app.releaseAttempts(r, app.ipSignInAttempt(r))
+
+	linked := &extended.Identity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		UserID:   user.ID,
+		Email:    identity.Email,
+	}
+
+	err := app.extended.Identities.Insert(linked)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrIdentityLinked):
+			app.errorResponse(w, r, http.StatusConflict, "this account is already linked to another user")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"identity": linked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	identities, err := app.extended.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"identities": identities}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/sms"
+	"github.com/pistolricks/validation"
+)
+
+// newSMSSender returns the SMS sender selected by the configuration.
+func (app *application) newSMSSender() (sms.Sender, error) {
+	switch app.config.sms.sender {
+	case "log":
+		return sms.LogSender{Logger: app.logger}, nil
+	case "file":
+		return &sms.FileSender{Path: app.config.sms.file}, nil
+	default:
+		return nil, fmt.Errorf("unknown sms sender %q", app.config.sms.sender)
+	}
+}
+
+// sendCode starts a one-time code of the purpose for the phone of the user,
+// and queues an SMS with it.
+func (app *application) sendCode(userID int64, phone, purpose string) error {
+	err := app.extended.PhoneCodes.New(userID, phone, purpose)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.jobs.Enqueue(jobPhoneCode, phoneCodeJob{
+		UserID:  userID,
+		Purpose: purpose,
+	})
+	return err
+}
+
+// createPhoneVerificationCodeHandler sends a code to the phone of the user's
+// profile, to prove they own it.
+func (app *application) createPhoneVerificationCodeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validation.New()
+
+	v.Check(profile.Phone != "", "phone", "must be set on your profile first")
+	v.Check(!profile.PhoneVerified, "phone", "is already verified")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.sendCode(profile.ID, profile.Phone, extended.PurposePhoneVerification)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrCodeThrottled):
+			app.rateLimitExceededResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"message": "a code will be sent to your phone"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) verifyPhoneHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidateCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	phone, err := app.extended.PhoneCodes.Verify(user.ID, extended.PurposePhoneVerification, input.Code)
+	if err == nil {
+		// The phone may have changed since the code was sent.
+		err = app.extended.Profiles.VerifyPhone(user.ID, phone)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidCode), errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("code", "invalid or expired code")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrDuplicatePhone):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPhoneLoginCodeHandler sends a sign-in code to a verified phone. The
+// response is the same whether or not the phone belongs to a user.
+func (app *application) createPhoneLoginCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Phone string `json:"phone"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidatePhone(v, input.Phone); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	profile, err := app.extended.Profiles.GetByPhone(input.Phone)
+	if err == nil {
+		err = app.sendCode(profile.ID, profile.Phone, extended.PurposePhoneLogin)
+	}
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) && !errors.Is(err, extended.ErrCodeThrottled) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "if the phone belongs to an account, a code will be sent to it"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPhoneAuthenticationTokenHandler signs a user in with a code sent to
+// their verified phone, as an alternative to their email and password.
+func (app *application) createPhoneAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Phone string `json:"phone"`
+		Code  string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	extended.ValidatePhone(v, input.Phone)
+	extended.ValidateCode(v, input.Code)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ip := app.ipSignInAttempt(r)
+	if !app.reserveAttempts(w, r, ip) {
+		return
+	}
+
+	profile, err := app.extended.Profiles.GetByPhone(input.Phone)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	account, _ := app.signInAttempts(r, profile.Email)
+	if !app.reserveAttempts(w, r, account) {
+		return
+	}
+
+	_, err = app.extended.PhoneCodes.Verify(profile.ID, extended.PurposePhoneLogin, input.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidCode):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.releaseAttempts(r, account, ip)
+
+	user, err := app.models.Users.GetByEmail(profile.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.signIn(w, r, user)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pistolricks/go-api-template/internal/ws"
+)
+
+func (app *application) showPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	presence, err := app.ws.Presences.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, ws.ErrRecordNotFound):
+			presence = &ws.Presence{UserID: id, Status: ws.StatusOffline}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The hub knows better than the stored status while this instance is
+	// serving WebSocket connections.
+	if app.hub != nil {
+		presence.Status = app.hub.Status(id)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"presence": presence}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
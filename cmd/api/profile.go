@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+)
+
+func (app *application) showProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateProfileHandler updates the fields present in the request. The
+// version read with the profile must be sent back, so concurrent edits are
+// rejected instead of lost. A new email address requires the password and
+// only becomes the user's once confirmed with the token sent to it; until
+// then the current address stays in place.
+func (app *application) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Version   *int    `json:"version"`
+		Name      *string `json:"name"`
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Username  *string `json:"username"`
+		Email     *string `json:"email"`
+		Phone     *string `json:"phone"`
+		Password  *string `json:"password"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if v.Check(input.Version != nil, "version", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if *input.Version != profile.Version {
+		app.editConflictResponse(w, r)
+		return
+	}
+
+	if input.Name != nil {
+		profile.Name = *input.Name
+	}
+	if input.FirstName != nil {
+		profile.FirstName = *input.FirstName
+	}
+	if input.LastName != nil {
+		profile.LastName = *input.LastName
+	}
+	if input.Username != nil {
+		profile.Username = *input.Username
+	}
+	if input.Phone != nil {
+		profile.Phone = *input.Phone
+	}
+
+	emailChanged := input.Email != nil && *input.Email != profile.Email
+	if emailChanged {
+		profile.PendingEmail = *input.Email
+		v.Check(input.Password != nil, "password", "must be provided to change the email address")
+	}
+
+	if extended.ValidateProfile(v, profile); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if emailChanged {
+		if !app.confirmPassword(w, r, user, *input.Password) {
+			return
+		}
+
+		other, err := app.models.Users.GetByEmail(profile.PendingEmail)
+		switch {
+		case err == nil && other.ID != user.ID:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case err != nil && !errors.Is(err, models.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.extended.Profiles.Update(profile)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrDuplicateUsername):
+			v.AddError("username", "a user with this username already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateUser(profile.ID)
+
+	env := envelope{"user": profile}
+
+	if emailChanged {
+		// Only the token sent to the latest address may confirm it.
+		err = app.models.Tokens.DeleteAllForUser(extended.ScopeEmailChange, profile.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		_, err = app.jobs.Enqueue(jobEmailChangeEmail, emailChangeEmailJob{
+			Email:  profile.PendingEmail,
+			UserID: profile.ID,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["message"] = "an email will be sent to the new address containing instructions to confirm it"
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailHandler makes the pending email address of a user theirs, with
+// the token sent to it.
+func (app *application) confirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(extended.ScopeEmailChange, input.TokenPlaintext)
+	if err == nil {
+		err = app.extended.Profiles.ConfirmEmail(user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound), errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": profile}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteProfileHandler soft-deletes the user once their password is
+// confirmed, ends their sessions and returns an export of their data.
+func (app *application) deleteProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	profile, err := app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data, err := app.extended.Profiles.Export(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.extended.Profiles.Delete(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.extended.Sessions.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+	app.invalidatePermissions(user.ID)
+
+	err = app.hub.Kick(user.ID, "account deleted")
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	env := envelope{
+		"message": "your account was successfully deleted",
+		"export":  envelope{"user": profile, "data": data},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
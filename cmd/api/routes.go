@@ -3,6 +3,7 @@ package main
 import (
 	"expvar"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pistolricks/go-api-template/internal/ws"
 	"net/http"
 )
 
@@ -19,32 +20,80 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/vendors", app.requirePermission("vendors:read", app.listVendorsHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/vendors", app.requirePermission("vendors:write", app.createVendorHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/vendors/:id", app.requirePermission("vendors:write", app.showVendorHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/vendors/:id", app.requirePermission("vendors:read", app.showVendorHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/vendors/:id", app.requirePermission("vendors:write", app.updateVendorHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/vendors/:id", app.requirePermission("vendors:write", app.deleteVendorHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/vendors/:id/route", app.requirePermission("vendors:read", app.vendorRouteHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/vendors/:id/route/map", app.requirePermission("vendors:read", app.vendorRouteMapHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/addresses/create", app.requirePermission("vendors:write", app.showAddressForm))
-	router.HandlerFunc(http.MethodPost, "/v1/addresses/search", app.requirePermission("vendors:write", app.addressSearchHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/addresses/details", app.requirePermission("vendors:write", app.addressDetailsHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/addresses/position", app.requirePermission("vendors:write", app.addressDetailsByCoordinates))
-	router.HandlerFunc(http.MethodPost, "/v1/addresses", app.requirePermission("vendors:write", app.createAddressHandler))
+	// httprouter will not share the /v1/vendors/:id segment with a static
+	// "tiles" path, so vendor tiles live under /v1/tiles instead.
+	router.HandlerFunc(http.MethodGet, "/v1/tiles/vendors/:z/:x/:y", app.requirePermission("vendors:read", app.vendorTilesHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/contents", app.requirePermission("vendors:write", app.listContentsHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/upload/image", app.requirePermission("vendors:write", app.uploadImageHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/maps/position", app.requirePermission("vendors:write", app.positionMapHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/addresses/create", app.requirePermission("addresses:write", app.showAddressForm))
+	router.HandlerFunc(http.MethodPost, "/v1/addresses/search", app.requirePermission("addresses:read", app.addressSearchHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/addresses/details", app.requirePermission("addresses:read", app.addressDetailsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/addresses/position", app.requirePermission("addresses:read", app.addressDetailsByCoordinates))
+	router.HandlerFunc(http.MethodPost, "/v1/addresses", app.requirePermission("addresses:write", app.createAddressHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users/find", app.requirePermission("vendors:read", app.showUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/contents", app.requirePermission("contents:read", app.listContentsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/upload/image", app.requirePermission("contents:write", app.uploadImageHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/maps/position", app.requirePermission("maps:write", app.positionMapHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/conversations", app.requirePermission(ws.PermissionMessagesRead, app.listConversationsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/conversations/:id/messages", app.requirePermission(ws.PermissionMessagesRead, app.listConversationMessagesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/ws", app.wsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/events", app.eventsHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/presence/:id", app.requirePermission(ws.PermissionMessagesRead, app.showPresenceHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/reports", app.requirePermission(ws.PermissionMessagesModerate, app.listReportsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/reports/:id", app.requirePermission(ws.PermissionMessagesModerate, app.updateReportHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/bans/:id", app.requirePermission(ws.PermissionMessagesModerate, app.banUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/bans/:id", app.requirePermission(ws.PermissionMessagesModerate, app.unbanUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:manage", app.listRolesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("users:manage", app.listUserRolesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles/:role", app.requirePermission("users:manage", app.grantRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("users:manage", app.revokeRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/two-factor", app.requirePermission("users:manage", app.resetTwoFactorHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/find", app.requirePermission("users:read", app.showUserHandler))
 
 	router.HandlerFunc(http.MethodGet, "/v1/users/activate", app.showActivateUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
-
-	router.HandlerFunc(http.MethodPost, "/v1/users/logout", app.requirePermission("vendors:read", app.userLogoutHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailHandler)
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/logout", app.requireAuthenticatedUser(app.userLogoutHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showProfileHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateProfileHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteProfileHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/phone/code", app.requireAuthenticatedUser(app.createPhoneVerificationCodeHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/phone/verified", app.requireAuthenticatedUser(app.verifyPhoneHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/two-factor", app.requireAuthenticatedUser(app.enrollTwoFactorHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/two-factor", app.requireAuthenticatedUser(app.confirmTwoFactorHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/two-factor", app.requireAuthenticatedUser(app.disableTwoFactorHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/two-factor/recovery-codes", app.requireAuthenticatedUser(app.createRecoveryCodesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/identities", app.requireAuthenticatedUser(app.listIdentitiesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/identities/:provider/authorization", app.requireAuthenticatedUser(app.createIdentityAuthorizationHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/identities/:provider", app.requireAuthenticatedUser(app.linkIdentityHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/oauth", app.listOAuthProvidersHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/:provider/authorization", app.createOAuthAuthorizationHandler)
 
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oauth/:provider", app.createOAuthAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/phone", app.createPhoneAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/phone/code", app.createPhoneLoginCodeHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/two-factor", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/revoke-all", app.requireAuthenticatedUser(app.revokeAllTokensHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
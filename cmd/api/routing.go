@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"image/png"
+	"net/http"
+	"time"
+
+	sm "github.com/flopp/go-staticmaps"
+	"github.com/golang/geo/s2"
+	"github.com/pistolricks/go-api-template/internal/api/routing"
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/validation"
+)
+
+func (app *application) newRoutingProvider() routing.Provider {
+	straight := routing.StraightLine{Speed: app.config.routing.speed}
+
+	switch app.config.routing.provider {
+	case "osrm":
+		return routing.Fallback{
+			Primary:   routing.OSRM{BaseURL: app.config.routing.osrmURL, Client: &http.Client{Timeout: 5 * time.Second}},
+			Secondary: straight,
+		}
+	default:
+		return straight
+	}
+}
+
+// readRoute resolves the vendor in the URL and the customer position in the
+// query string and asks the routing provider for the route between them.
+func (app *application) readRoute(w http.ResponseWriter, r *http.Request) (*extended.VendorLocation, routing.Point, *routing.Route, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, routing.Point{}, nil, false
+	}
+
+	v := validation.New()
+	qs := r.URL.Query()
+
+	customer := routing.Point{
+		Lat: app.readFloat(qs, "lat", 0, v),
+		Lng: app.readFloat(qs, "lng", 0, v),
+	}
+
+	v.Check(qs.Get("lat") != "", "lat", "must be provided")
+	v.Check(qs.Get("lng") != "", "lng", "must be provided")
+	v.Check(customer.Lat >= -90 && customer.Lat <= 90, "lat", "must be between -90 and 90")
+	v.Check(customer.Lng >= -180 && customer.Lng <= 180, "lng", "must be between -180 and 180")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, routing.Point{}, nil, false
+	}
+
+	vendor, err := app.extended.Vendors.GetLocation(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, routing.Point{}, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	route, err := app.routing.Route(ctx, customer, routing.Point{Lat: vendor.Lat, Lng: vendor.Lng})
+	if err != nil {
+		switch {
+		case errors.Is(err, routing.ErrNoRoute):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "no route could be found to this vendor")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, routing.Point{}, nil, false
+	}
+
+	return vendor, customer, route, true
+}
+
+func (app *application) vendorRouteHandler(w http.ResponseWriter, r *http.Request) {
+	vendor, customer, route, ok := app.readRoute(w, r)
+	if !ok {
+		return
+	}
+
+	env := envelope{
+		"vendor":                vendor,
+		"customer":              customer,
+		"great_circle_distance": routing.Distance(customer, routing.Point{Lat: vendor.Lat, Lng: vendor.Lng}),
+		"travel_distance":       route.Distance,
+		"travel_time":           int64(route.Duration.Seconds()),
+		"route":                 route,
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) vendorRouteMapHandler(w http.ResponseWriter, r *http.Request) {
+	vendor, customer, route, ok := app.readRoute(w, r)
+	if !ok {
+		return
+	}
+
+	path := make([]s2.LatLng, 0, len(route.Path))
+	for _, p := range route.Path {
+		path = append(path, s2.LatLngFromDegrees(p.Lat, p.Lng))
+	}
+
+	ctx := sm.NewContext()
+	ctx.SetSize(600, 400)
+
+	ctx.OverrideAttribution(vendor.Name)
+	ctx.AddObject(sm.NewPath(path, color.RGBA{0, 0, 0xff, 0xff}, 4.0))
+	ctx.AddObject(
+		sm.NewMarker(
+			s2.LatLngFromDegrees(customer.Lat, customer.Lng),
+			color.RGBA{0, 0x80, 0, 0xff},
+			16.0,
+		),
+	)
+	ctx.AddObject(
+		sm.NewMarker(
+			s2.LatLngFromDegrees(vendor.Lat, vendor.Lng),
+			color.RGBA{0xff, 0, 0, 0xff},
+			16.0,
+		),
+	)
+
+	img, err := ctx.Render()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(http.StatusOK)
+
+	err = png.Encode(w, img)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -21,8 +21,15 @@ func (app *application) serve() error {
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
 
+	// Hijacked WebSocket connections are not tracked by Shutdown, and event
+	// streams only end when the hub closes them, so close the hub as soon as
+	// shutdown starts.
+	srv.RegisterOnShutdown(app.hub.Close)
+
 	shutdownError := make(chan error)
 
+	go app.jobs.Run()
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -41,7 +48,20 @@ func (app *application) serve() error {
 
 		app.logger.Info("completing background tasks", "addr", srv.Addr)
 
-		app.wg.Wait()
+		// Let the running jobs complete, then drain the tasks already queued
+		// on the worker pool, such as presence writes and pending frames.
+		err = app.jobs.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+
+		err = app.pool.Shutdown(ctx)
+		if err != nil {
+			shutdownError <- err
+			return
+		}
+
 		shutdownError <- nil
 	}()
 
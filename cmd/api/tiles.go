@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/paulmach/orb/maptile"
+	"github.com/pistolricks/go-api-template/internal/extended"
+)
+
+func (app *application) readTileParams(r *http.Request) (maptile.Tile, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	z, err := strconv.ParseUint(params.ByName("z"), 10, 32)
+	if err != nil || z > 22 {
+		return maptile.Tile{}, errors.New("invalid zoom")
+	}
+
+	x, err := strconv.ParseUint(params.ByName("x"), 10, 32)
+	if err != nil {
+		return maptile.Tile{}, errors.New("invalid x")
+	}
+
+	y, err := strconv.ParseUint(strings.TrimSuffix(params.ByName("y"), ".mvt"), 10, 32)
+	if err != nil {
+		return maptile.Tile{}, errors.New("invalid y")
+	}
+
+	tile := maptile.New(uint32(x), uint32(y), maptile.Zoom(z))
+	if !tile.Valid() {
+		return maptile.Tile{}, errors.New("tile out of range")
+	}
+
+	return tile, nil
+}
+
+func (app *application) vendorTilesHandler(w http.ResponseWriter, r *http.Request) {
+	tile, err := app.readTileParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	bound := tile.Bound()
+
+	locations, err := app.extended.Vendors.GetAllInBound(bound.Min.Lat(), bound.Min.Lon(), bound.Max.Lat(), bound.Max.Lon())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data, err := extended.VendorTile(tile, locations)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+
+	if noneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// noneMatch reports whether the If-None-Match headers of the request list
+// the entity tag, or "*". Tags are compared weakly, ignoring their W/ prefix.
+func noneMatch(r *http.Request, etag string) bool {
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
 	"github.com/pistolricks/models/cmd/models"
 	"github.com/pistolricks/validation"
 	"net/http"
-	"time"
 )
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,6 +29,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	account, ip := app.signInAttempts(r, input.Email)
+	if !app.reserveAttempts(w, r, account, ip) {
+		return
+	}
+
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
@@ -51,7 +56,36 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, models.ScopeAuthentication)
+	// Deleted users keep their row, so they must be turned away here.
+	_, err = app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.releaseAttempts(r, account, ip)
+
+	app.signIn(w, r, user)
+}
+
+// startSession signs the user in: it creates a session for the client and
+// writes its first access and refresh tokens. The failed sign-ins with their
+// email address are forgotten, since every factor was checked by now.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	app.resetSignIn(r, user.Email)
+
+	session := &extended.Session{
+		UserID:    user.ID,
+		IP:        app.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	pair, err := app.extended.RefreshTokens.Issue(session, app.config.auth.accessTTL, app.config.auth.refreshTTL)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -59,16 +93,18 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	folder := app.handleEncodeHashids(user.ID, "Ollivr")
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "user": user, "folder": folder}, nil)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": pair.Access, "refresh_token": pair.Refresh, "user": user, "folder": folder}, nil)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+// refreshAuthenticationTokenHandler exchanges a refresh token for a new
+// access token and refresh token. A refresh token can only be used once.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email string `json:"email"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -79,47 +115,87 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 
 	v := validation.New()
 
-	if models.ValidateEmail(v, input.Email); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	if models.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	pair, err := app.extended.RefreshTokens.Rotate(input.RefreshToken, app.config.auth.accessTTL, app.config.auth.refreshTTL)
 	if err != nil {
 		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			v.AddError("email", "no matching email address found")
-			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, extended.ErrTokenReused):
+			app.invalidateUser(pair.UserID)
+			app.logger.Warn("refresh token reused, token family revoked", "method", r.Method, "uri", r.URL.RequestURI())
+			app.invalidAuthenticationTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	if !user.Activated {
-		v.AddError("email", "user account must be activated")
-		app.failedValidationResponse(w, r, v.Errors)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": pair.Access, "refresh_token": pair.Refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeAllTokensHandler ends every session of the user, including the
+// current one.
+func (app *application) revokeAllTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.extended.Sessions.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, models.ScopePasswordReset)
+	app.invalidateUser(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all sessions successfully revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createPasswordResetTokenHandler emails a password reset token. The
+// response is the same whether or not the email address belongs to an
+// activated user, and whether or not it was throttled.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]any{
-			"passwordResetToken": token.Plaintext,
-		}
+	v := validation.New()
 
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
+	if models.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	account, ip := app.passwordResetAttempts(r, input.Email)
+	if !app.reserveAttempts(w, r, ip) {
+		return
+	}
+
+	wait, _, err := app.extended.Attempts.Reserve(account.key, account.policy)
+	if err == nil && wait == 0 {
+		err = app.sendPasswordResetToken(input.Email)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "if the email address belongs to an activated account, an email will be sent to it containing password reset instructions"}
 
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
@@ -127,6 +203,28 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 }
 
+// sendPasswordResetToken queues an email with a password reset token, if
+// the email address belongs to an activated user.
+func (app *application) sendPasswordResetToken(email string) error {
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if !user.Activated {
+		return nil
+	}
+
+	_, err = app.jobs.Enqueue(jobPasswordResetEmail, passwordResetEmailJob{
+		Email:  user.Email,
+		UserID: user.ID,
+	})
+	return err
+}
+
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email string `json:"email"`
@@ -157,29 +255,34 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	// Deleted users are not activated either, but must stay deleted.
+	_, err = app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	if user.Activated {
 		v.AddError("email", "user has already been activated")
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, models.ScopeActivation)
+	_, err = app.jobs.Enqueue(jobActivationEmail, activationEmailJob{
+		Email:  user.Email,
+		UserID: user.ID,
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
-
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
 
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
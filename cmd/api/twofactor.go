@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pistolricks/go-api-template/internal/extended"
+	"github.com/pistolricks/go-api-template/internal/totp"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+)
+
+// twoFactorTTL is how long a user has to enter their second factor once
+// their first one was checked.
+const twoFactorTTL = 5 * time.Minute
+
+// signIn starts a session for a user who proved their first factor. Users
+// with two-factor authentication get a token to exchange with their second
+// factor on /v1/tokens/two-factor instead.
+func (app *application) signIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	enabled, err := app.extended.TwoFactor.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.startSession(w, r, user)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, twoFactorTTL, extended.ScopeTwoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"two_factor_token": token,
+		"message":          "enter a code from your authenticator app or a recovery code",
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// validateSecondFactor checks that exactly one of a TOTP code and a recovery
+// code was entered.
+func validateSecondFactor(v *validation.Validator, code, recoveryCode string) {
+	switch {
+	case code != "" && recoveryCode != "":
+		v.AddError("code", "must not be provided with a recovery code")
+	case recoveryCode != "":
+		v.Check(len(recoveryCode) <= 32, "recovery_code", "must not be more than 32 bytes long")
+	default:
+		extended.ValidateCode(v, code)
+	}
+}
+
+// checkSecondFactor checks a TOTP code or a recovery code of the user. It
+// returns extended.ErrInvalidCode when neither matches; after MaxCodeAttempts
+// wrong ones the pending two-factor tokens of the user are discarded, so
+// their password has to be checked again.
+func (app *application) checkSecondFactor(userID int64, code, recoveryCode string) error {
+	var err error
+
+	if recoveryCode != "" {
+		err = app.extended.TwoFactor.UseRecoveryCode(userID, recoveryCode)
+	} else {
+		err = app.checkTOTP(userID, code)
+	}
+	if !errors.Is(err, extended.ErrInvalidCode) {
+		return err
+	}
+
+	exhausted, failErr := app.extended.TwoFactor.Fail(userID)
+	if failErr != nil {
+		return failErr
+	}
+
+	if exhausted {
+		failErr = app.models.Tokens.DeleteAllForUser(extended.ScopeTwoFactor, userID)
+		if failErr != nil {
+			return failErr
+		}
+	}
+
+	return err
+}
+
+// checkTOTP checks a code of the user's authenticator app. A code can only
+// be used once.
+func (app *application) checkTOTP(userID int64, code string) error {
+	tf, err := app.extended.TwoFactor.Get(userID)
+	if err != nil {
+		return err
+	}
+
+	step, ok := totp.Validate(tf.Secret, code, time.Now())
+	if !ok || !tf.Confirmed {
+		return extended.ErrInvalidCode
+	}
+
+	return app.extended.TwoFactor.Use(userID, step)
+}
+
+// createTwoFactorAuthenticationTokenHandler completes a sign-in with the
+// second factor of the user.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TwoFactorToken string `json:"two_factor_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	models.ValidateTokenPlaintext(v, input.TwoFactorToken)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ip := app.ipSignInAttempt(r)
+	if !app.reserveAttempts(w, r, ip) {
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(extended.ScopeTwoFactor, input.TwoFactorToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("two_factor_token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Wrong codes count against the account like wrong passwords, so getting
+	// a new two-factor token with the password does not allow more guesses.
+	account, _ := app.signInAttempts(r, user.Email)
+	if !app.reserveAttempts(w, r, account) {
+		return
+	}
+
+	err = app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidCode), errors.Is(err, extended.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.releaseAttempts(r, account, ip)
+
+	err = app.models.Tokens.DeleteAllForUser(extended.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.startSession(w, r, user)
+}
+
+// enrollTwoFactorHandler creates a TOTP secret for the user, to add to their
+// authenticator app. It protects the account once confirmed with a code.
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if models.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.extended.TwoFactor.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrTwoFactorEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret": secret,
+		"uri":    totp.URI(app.config.auth.totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTwoFactorHandler enables two-factor authentication with a first
+// code of the authenticator app, and returns the recovery codes. They are
+// not shown again.
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidateCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	tf, err := app.extended.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.extended.TwoFactor.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrTwoFactorEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"message":        "two-factor authentication successfully enabled, store the recovery codes somewhere safe",
+		"recovery_codes": codes,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRecoveryCodesHandler replaces the recovery codes of the user.
+func (app *application) createRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	if extended.ValidateCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.checkSecondFactor(user.ID, input.Code, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidCode):
+			v.AddError("code", "invalid code")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	codes, err := app.extended.TwoFactor.ReplaceRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler turns two-factor authentication off once the user
+// confirmed both their password and their second factor.
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validation.New()
+
+	models.ValidatePasswordPlaintext(v, input.Password)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if !app.confirmPassword(w, r, user, input.Password) {
+		return
+	}
+
+	err = app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err == nil {
+		err = app.extended.TwoFactor.Delete(user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrInvalidCode):
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resetTwoFactorHandler turns two-factor authentication off for the user in
+// the URL, for users who lost both their device and their recovery codes.
+func (app *application) resetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.extended.TwoFactor.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	admin := app.contextGetUser(r)
+
+	app.logger.Info("two-factor authentication reset", "user", id, "by", admin.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
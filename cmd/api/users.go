@@ -2,10 +2,10 @@ package main
 
 import (
 	"errors"
+	"github.com/pistolricks/go-api-template/internal/extended"
 	"github.com/pistolricks/models/cmd/models"
 	"github.com/pistolricks/validation"
 	"net/http"
-	"time"
 )
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -52,35 +52,21 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "vendors:read")
+	err = app.extended.Roles.AddForUser(user.ID, extended.RoleCustomer, 0)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.ID, "vendors:write")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, models.ScopeActivation)
+	_, err = app.jobs.Enqueue(jobWelcomeEmail, welcomeEmailJob{
+		Email:  user.Email,
+		UserID: user.ID,
+	})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		data := map[string]any{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-	})
-
 	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -133,6 +119,18 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	_, err = app.extended.Profiles.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, extended.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired token activation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	user.Activated = true
 
 	err = app.models.Users.Update(user)
@@ -152,6 +150,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.invalidateUser(user.ID)
+
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -215,6 +215,18 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// Whoever knew the old password must not stay signed in with it.
+	err = app.extended.Sessions.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	// Choosing a new password unlocks the account.
+	app.resetSignIn(r, user.Email)
+
 	env := envelope{"message": "your password was successfully reset"}
 
 	err = app.writeJSON(w, http.StatusOK, env, nil)
@@ -223,16 +235,38 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 	}
 }
 
+// userLogoutHandler ends the session of the presented token, so neither it
+// nor the session's refresh token can be used anymore.
 func (app *application) userLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.extended.Sessions.DeleteForToken(app.contextGetToken(r))
+	if err != nil && !errors.Is(err, extended.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	user := app.contextClearUser(r)
-	if user == nil {
+	// The session's earlier access tokens were deleted too, so drop every
+	// cached token of the user rather than just this one.
+	app.invalidateUser(app.contextGetUser(r).ID)
 
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": nil}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler lists the sessions of the user that can still be used.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.extended.Sessions.GetAllForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	err := app.writeJSON(w, http.StatusOK, envelope{"user": nil}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
 	if err != nil {
-		app.errorResponse(w, r, http.StatusUnprocessableEntity, err)
+		app.serverErrorResponse(w, r, err)
 	}
 }
 
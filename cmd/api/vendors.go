@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/pistolricks/go-api-template/internal/extended"
+	iws "github.com/pistolricks/go-api-template/internal/ws"
 	"github.com/pistolricks/validation"
 	"net/http"
 	"strconv"
@@ -11,10 +12,11 @@ import (
 
 func (app *application) createVendorHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string           `json:"title"`
-		Year    int32            `json:"year"`
-		Runtime extended.Runtime `json:"runtime"`
-		Genres  []string         `json:"genres"`
+		Title     string           `json:"title"`
+		Year      int32            `json:"year"`
+		Runtime   extended.Runtime `json:"runtime"`
+		Genres    []string         `json:"genres"`
+		AddressID string           `json:"address_id"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -24,10 +26,12 @@ func (app *application) createVendorHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	vendor := &extended.Vendor{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		AddressID: input.AddressID,
+		UserID:    app.contextGetUser(r).ID,
 	}
 
 	v := validation.New()
@@ -43,6 +47,8 @@ func (app *application) createVendorHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.notifyVendor(r, "created", vendor)
+
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/vendors/%d", vendor.ID))
 
@@ -99,10 +105,11 @@ func (app *application) updateVendorHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	var input struct {
-		Title   *string           `json:"title"`
-		Year    *int32            `json:"year"`
-		Runtime *extended.Runtime `json:"runtime"`
-		Genres  []string          `json:"genres"`
+		Title     *string           `json:"title"`
+		Year      *int32            `json:"year"`
+		Runtime   *extended.Runtime `json:"runtime"`
+		Genres    []string          `json:"genres"`
+		AddressID *string           `json:"address_id"`
 	}
 
 	err = app.readJSON(w, r, &input)
@@ -124,6 +131,9 @@ func (app *application) updateVendorHandler(w http.ResponseWriter, r *http.Reque
 	if input.Genres != nil {
 		vendor.Genres = input.Genres
 	}
+	if input.AddressID != nil {
+		vendor.AddressID = *input.AddressID
+	}
 
 	v := validation.New()
 
@@ -143,6 +153,8 @@ func (app *application) updateVendorHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.notifyVendor(r, "updated", vendor)
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"vendor": vendor}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -167,6 +179,8 @@ func (app *application) deleteVendorHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	app.notifyVendor(r, "deleted", iws.Object{"id": id})
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "vendor successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -209,3 +223,15 @@ func (app *application) listVendorsHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// notifyVendor tells connected clients that a vendor was created, updated or
+// deleted. Failing to notify them does not fail the request.
+func (app *application) notifyVendor(r *http.Request, action string, vendor any) {
+	err := app.hub.Broadcast("vendor", iws.Object{
+		"action": action,
+		"vendor": vendor,
+	})
+	if err != nil {
+		app.logError(r, err)
+	}
+}
@@ -4,170 +4,223 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/mailru/easygo/netpoll"
-	gopool "github.com/pistolricks/go-api-template/internal/pool"
 	iws "github.com/pistolricks/go-api-template/internal/ws"
-	"log"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
+// websockets prepares the chat hub and the netpoll instance used by
+// wsHandler. Connections are accepted by the API server on /v1/ws.
 func (app *application) websockets() error {
 
 	if x := app.config.ws.debug; x != "" {
-
-		m1 := fmt.Sprintf("starting pprof server on %s", x)
-		app.logger.Info(m1)
-		m2 := fmt.Sprintf("pprof server error: %v", http.ListenAndServe(x, nil))
 		go func() {
+			m1 := fmt.Sprintf("starting pprof server on %s", x)
+			app.logger.Info(m1)
+			m2 := fmt.Sprintf("pprof server error: %v", http.ListenAndServe(x, nil))
 			app.logger.Info(m2)
 		}()
 	}
 
+	switch app.config.ws.slowPolicy {
+	case iws.SlowDrop, iws.SlowDisconnect:
+	default:
+		return fmt.Errorf("unknown ws slow policy %q", app.config.ws.slowPolicy)
+	}
+
 	// Initialize netpoll instance. We will use it to be noticed about incoming
-	// events from listener of user connections.
+	// events from user connections.
 	poller, err := netpoll.New(nil)
 	if err != nil {
 		return err
 	}
 
-	var (
-		// Make pool of X size, Y sized work queue and one pre-spawned
-		// goroutine.
-		pool    = gopool.NewPool(app.config.ws.workers, app.config.ws.queue, 1)
-		message = iws.NewMessage(pool)
-		exit    = make(chan struct{})
-	)
-	// handle is a new incoming messageion handler.
-	// It upgrades TCP connection to WebSocket, registers netpoll listener on
-	// it and stores it as a chat user in Chat instance.
-	//
-	// We will call it below within accept() loop.
-	handle := func(conn net.Conn) {
-		// NOTE: we wrap conn here to show that ws could work with any kind of
-		// io.ReadWriter.
-		safeConn := deadliner{conn, app.config.ws.ioTimeout}
-
-		// Zero-copy upgrade to WebSocket connection.
-		hs, err := ws.Upgrade(safeConn)
-		if err != nil {
-			m3 := fmt.Sprintf("%s: upgrade error: %v", nameConn(conn), err)
-			app.logger.Info(m3)
-			err := conn.Close()
-			if err != nil {
-				return
-			}
+	app.poller = poller
+	app.hub = iws.NewMessage(app.pool, app.ws, app.backplane, iws.Config{
+		PingInterval:     app.config.ws.pingInterval,
+		PongTimeout:      app.config.ws.pongTimeout,
+		PresenceInterval: app.config.ws.presenceInterval,
+		PresenceTTL:      app.config.ws.presenceTTL,
+		SendQueue:        app.config.ws.sendQueue,
+		SlowPolicy:       app.config.ws.slowPolicy,
+		RateLimit:        app.config.ws.rateLimit,
+		RateBurst:        app.config.ws.rateBurst,
+		Filter:           app.chatFilter(),
+		Policy:           chatPolicy{app: app},
+	})
+
+	return nil
+}
+
+// wsHandler is a new incoming connection handler.
+// It upgrades the HTTP connection to WebSocket, registers netpoll listener on
+// it and stores it as a chat user in the hub.
+func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && len(app.config.cors.trustedOrigins) > 0 {
+		if !slices.Contains(app.config.cors.trustedOrigins, origin) {
+			app.notPermittedResponse(w, r)
 			return
 		}
-		m4 := fmt.Sprintf("%s: established websocket connection: %+v", nameConn(conn), hs)
-		app.logger.Info(m4)
-		// Register incoming user in chat.
-		agent := message.Register(safeConn)
-
-		// Create netpoll event descriptor for conn.
-		// We want to handle only read events of it.
-		desc := netpoll.Must(netpoll.HandleRead(conn))
-
-		// Subscribe to events about conn.
-		err = poller.Start(desc, func(ev netpoll.Event) {
-			if err != nil {
-				return
-			}
-			if ev&(netpoll.EventReadHup|netpoll.EventHup) != 0 {
-				// When ReadHup or Hup received, this mean that client has
-				// closed at least write end of the connection or connections
-				// itself. So we want to stop receive events about such conn
-				// and remove it from the chat registry.
-				err := poller.Stop(desc)
-				if err != nil {
-					return
-				}
-				message.Remove(agent)
-				return
-			}
-			// Here we can read some new message from connection.
-			// We can not read it right here in callback, because then we will
-			// block the poller's inner loop.
-			// We do not want to spawn a new goroutine to read single message.
-			// But we want to reuse previously spawned goroutine.
-			pool.Schedule(func() {
-				if err := agent.Receive(); err != nil {
-					// When receive failed, we can only disconnect broken
-					// connection and stop to receive events about it.
-					err := poller.Stop(desc)
-					if err != nil {
-						return
-					}
-					message.Remove(agent)
-				}
-			})
-		})
-		if err != nil {
+	}
+
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		var ok bool
+		if user, ok = app.queryTokenUser(w, r); !ok {
 			return
 		}
 	}
 
-	ln, err := net.Listen("tcp", app.config.ws.addr)
-	if err != nil {
-		return err
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
 	}
-	m5 := fmt.Sprintf("websocket is listening on %s", ln.Addr().String())
-	app.logger.Info(m5)
 
-	// Create netpoll descriptor for the listener.
-	// We use OneShot here to manually resume events stream when we want to.
-	acceptDesc := netpoll.Must(netpoll.HandleListener(
-		ln, netpoll.EventRead|netpoll.EventOneShot,
-	))
+	if app.chatBanned(w, r, user.ID) {
+		return
+	}
 
-	// accept is a channel to signal about next incoming connection Accept()
-	// results.
-	accept := make(chan error, 1)
+	permissions, err := app.permissionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// Subscribe to events about listener.
-	err = poller.Start(acceptDesc, func(e netpoll.Event) {
+	// Browsers cannot set headers on WebSocket requests, so clients passing
+	// the token as a subprotocol should also offer the protocol they actually
+	// speak; it is the one selected in the response.
+	e := wsflate.Extension{
+		Parameters: wsflate.DefaultParameters,
+	}
+	u := ws.HTTPUpgrader{
+		Protocol: func(p string) bool {
+			return p == iws.ProtocolJSON || p == iws.ProtocolMsgpack
+		},
+		Negotiate: e.Negotiate,
+	}
 
-		err := pool.ScheduleTimeout(time.Millisecond, func() {
-			conn, err := ln.Accept()
-			if err != nil {
-				accept <- err
-				return
-			}
+	conn, _, hs, err := u.Upgrade(r, w)
+	if err != nil {
+		m3 := fmt.Sprintf("%s: upgrade error: %v", r.RemoteAddr, err)
+		app.logger.Info(m3)
+		return
+	}
+	m4 := fmt.Sprintf("%s: established websocket connection: %+v", nameConn(conn), hs)
+	app.logger.Info(m4)
+
+	_, compress := e.Accepted()
+
+	// NOTE: we wrap conn here to show that ws could work with any kind of
+	// io.ReadWriter. It also replaces the deadlines left by the HTTP server.
+	safeConn := deadliner{conn, app.config.ws.ioTimeout}
+
+	// Register incoming user in chat.
+	agent, err := app.hub.Register(safeConn, iws.Client{
+		UserID:      user.ID,
+		Name:        user.Name,
+		Permissions: permissions,
+		Codec:       iws.CodecFor(hs.Protocol),
+		Compress:    compress,
+	})
+	if err != nil {
+		app.logError(r, err)
+		conn.Close()
+		return
+	}
 
-			accept <- nil
-			handle(conn)
-		})
-		if err == nil {
-			err = <-accept
-		}
-		if err != nil {
-			if !errors.Is(err, gopool.ErrScheduleTimeout) {
-				goto cooldown
-			}
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				goto cooldown
-			}
+	// Create netpoll event descriptor for conn.
+	// We want to handle only read events of it.
+	desc, err := netpoll.HandleRead(conn)
+	if err != nil {
+		app.hub.Remove(agent)
+		conn.Close()
+		return
+	}
 
-			log.Fatalf("accept error: %v", err)
+	// Stop polling the connection when the hub evicts it, e.g. after missed
+	// pongs or a full send queue.
+	agent.OnClose(func() {
+		app.poller.Stop(desc)
+		desc.Close()
+	})
 
-		cooldown:
-			delay := 5 * time.Millisecond
-			log.Printf("accept error: %v; retrying in %s", err, delay)
-			time.Sleep(delay)
+	// Subscribe to events about conn.
+	err = app.poller.Start(desc, func(ev netpoll.Event) {
+		if ev&(netpoll.EventReadHup|netpoll.EventHup) != 0 {
+			// When ReadHup or Hup received, this mean that client has
+			// closed at least write end of the connection or connections
+			// itself. So we want to stop receive events about such conn
+			// and remove it from the chat registry.
+			app.poller.Stop(desc)
+			app.hub.Remove(agent)
+			return
 		}
-
-		err = poller.Resume(acceptDesc)
+		// Here we can read some new message from connection.
+		// We can not read it right here in callback, because then we will
+		// block the poller's inner loop.
+		// We do not want to spawn a new goroutine to read single message.
+		// But we want to reuse previously spawned goroutine.
+		err := app.pool.Schedule(func() {
+			if err := agent.Receive(); err != nil {
+				// When receive failed, we can only disconnect broken
+				// connection and stop to receive events about it.
+				app.poller.Stop(desc)
+				app.hub.Remove(agent)
+			}
+		})
 		if err != nil {
-			return
+			// The pool is closed, so the server is shutting down.
+			app.poller.Stop(desc)
+			app.hub.Remove(agent)
 		}
 	})
 	if err != nil {
-		return err
+		app.hub.Remove(agent)
+		conn.Close()
 	}
+}
 
-	<-exit
-	return nil
+// queryTokenUser looks for an authentication token in the "token" query
+// parameter or a "bearer.<token>" subprotocol, for clients such as browsers
+// that cannot set the Authorization header on WebSocket and EventSource
+// requests, and returns its user. It writes the error response itself and
+// reports false when there is no valid token.
+func (app *application) queryTokenUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		for _, p := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "bearer.") {
+				token = strings.TrimPrefix(p, "bearer.")
+				break
+			}
+		}
+	}
+
+	v := validation.New()
+	if models.ValidateTokenPlaintext(v, token); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return nil, false
+	}
+
+	user, _, err := app.userForToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
 }
 
 func nameConn(conn net.Conn) string {
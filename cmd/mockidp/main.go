@@ -0,0 +1,251 @@
+// Command mockidp is an OpenID Connect identity provider for development and
+// tests. It signs every user in without asking, as the user given by its
+// flags, or by the sub, email, name and email_verified parameters of the
+// authorization request.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type config struct {
+	addr          string
+	issuer        string
+	clientID      string
+	clientSecret  string
+	subject       string
+	email         string
+	name          string
+	emailVerified bool
+}
+
+type claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name,omitempty"`
+}
+
+type grant struct {
+	claims      claims
+	redirectURI string
+	challenge   string
+	expiry      time.Time
+}
+
+type provider struct {
+	config config
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	codes  map[string]grant
+	tokens map[string]claims
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.addr, "addr", ":9000", "Listen address")
+	flag.StringVar(&cfg.issuer, "issuer", "http://localhost:9000", "Issuer URL, as clients reach it")
+	flag.StringVar(&cfg.clientID, "client-id", "api", "Client ID")
+	flag.StringVar(&cfg.clientSecret, "client-secret", "secret", "Client secret")
+	flag.StringVar(&cfg.subject, "sub", "mock-user", "Default user ID")
+	flag.StringVar(&cfg.email, "email", "mock@example.com", "Default user email")
+	flag.StringVar(&cfg.name, "name", "Mock User", "Default user name")
+	flag.BoolVar(&cfg.emailVerified, "email-verified", true, "Default user email is verified")
+
+	flag.Parse()
+
+	p := &provider{
+		config: cfg,
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		codes:  map[string]grant{},
+		tokens: map[string]claims{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /userinfo", p.userinfo)
+
+	p.logger.Info("mock identity provider listening", "addr", cfg.addr, "issuer", cfg.issuer)
+
+	err := http.ListenAndServe(cfg.addr, mux)
+	p.logger.Error(err.Error())
+	os.Exit(1)
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := strings.TrimSuffix(p.config.issuer, "/")
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                           issuer,
+		"authorization_endpoint":           issuer + "/authorize",
+		"token_endpoint":                   issuer + "/token",
+		"userinfo_endpoint":                issuer + "/userinfo",
+		"response_types_supported":         []string{"code"},
+		"code_challenge_methods_supported": []string{"S256"},
+		"scopes_supported":                 []string{"openid", "email", "profile"},
+	})
+}
+
+// authorize redirects back to the client with a code right away.
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	switch {
+	case qs.Get("response_type") != "code":
+		http.Error(w, "response_type must be code", http.StatusBadRequest)
+		return
+	case qs.Get("client_id") != p.config.clientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case qs.Get("code_challenge") == "" || qs.Get("code_challenge_method") != "S256":
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(qs.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	c := claims{
+		Subject:       p.config.subject,
+		Email:         p.config.email,
+		EmailVerified: p.config.emailVerified,
+		Name:          p.config.name,
+	}
+	if v := qs.Get("sub"); v != "" {
+		c.Subject = v
+	}
+	if qs.Has("email") {
+		c.Email = qs.Get("email")
+	}
+	if v := qs.Get("name"); v != "" {
+		c.Name = v
+	}
+	if v := qs.Get("email_verified"); v != "" {
+		c.EmailVerified = v == "true"
+	}
+
+	code := randomString()
+
+	p.mu.Lock()
+	p.codes[code] = grant{
+		claims:      c,
+		redirectURI: redirect.String(),
+		challenge:   qs.Get("code_challenge"),
+		expiry:      time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", qs.Get("state"))
+	redirect.RawQuery = params.Encode()
+
+	p.logger.Info("authorized", "sub", c.Subject, "email", c.Email)
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a code for an access token, checking the PKCE verifier.
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID != p.config.clientID || clientSecret != p.config.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	switch {
+	case !ok, time.Now().After(g.expiry), g.redirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, "invalid_grant")
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	accessToken := randomString()
+
+	p.mu.Lock()
+	p.tokens[accessToken] = g.claims
+	p.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (p *provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	accessToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	p.mu.Lock()
+	c, found := p.tokens[accessToken]
+	p.mu.Unlock()
+
+	if !ok || !found {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func randomString() string {
+	randomBytes := make([]byte, 24)
+	rand.Read(randomBytes)
+	return base64.RawURLEncoding.EncodeToString(randomBytes)
+}
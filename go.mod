@@ -7,18 +7,22 @@ require (
 	github.com/devedge/imagehash v0.0.0-20180324030135-7061aa3b4066
 	github.com/flopp/go-staticmaps v0.0.0-20250206111937-47d062eaabce
 	github.com/fogleman/gg v1.3.0
+	github.com/go-mail/mail/v2 v2.3.0
 	github.com/gobwas/httphead v0.1.0
 	github.com/gobwas/ws v1.4.0
 	github.com/golang/geo v0.0.0-20230421003525-6adc56603217
 	github.com/indrasaputra/hashids v0.2.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/lib/pq v1.10.9
+	github.com/mailru/easygo v0.0.0-20190618140210-3c14a0dc985f
 	github.com/paulmach/go.geojson v1.5.0
+	github.com/paulmach/orb v0.13.0
 	github.com/pistolricks/mailer v0.1.0
 	github.com/pistolricks/models v0.1.3
 	github.com/pistolricks/validation v0.1.0
 	github.com/speps/go-hashids/v2 v2.0.1
 	github.com/tomasen/realip v0.0.0-20180522021738-f0c99a92ddce
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 	golang.org/x/time v0.9.0
 )
 
@@ -26,13 +30,15 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/disintegration/imaging v1.6.2 // indirect
 	github.com/flopp/go-coordsparser v0.0.0-20240403152942-4891dc40d0a7 // indirect
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
-	github.com/mailru/easygo v0.0.0-20190618140210-3c14a0dc985f // indirect
 	github.com/mazznoer/csscolorparser v0.1.5 // indirect
+	github.com/paulmach/protoscan v0.2.1 // indirect
 	github.com/speps/go-hashids v2.0.0+incompatible // indirect
 	github.com/tkrajina/gpxgo v1.4.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.mongodb.org/mongo-driver/v2 v2.5.0 // indirect
 	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/image v0.24.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
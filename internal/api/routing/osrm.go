@@ -0,0 +1,98 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultOSRMURL is the public OSRM demo server.
+const DefaultOSRMURL = "https://router.project-osrm.org"
+
+// OSRM is a Provider backed by an OSRM-compatible HTTP routing service.
+type OSRM struct {
+	BaseURL string       // BaseURL is the service root, e.g. http://localhost:5000.
+	Profile string       // Profile is the routing profile, defaults to "driving".
+	Client  *http.Client // Client is the HTTP client used, defaults to http.DefaultClient.
+}
+
+type osrmResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Routes  []struct {
+		Distance float64 `json:"distance"`
+		Duration float64 `json:"duration"`
+		Geometry struct {
+			Coordinates [][]float64 `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"routes"`
+}
+
+// Route asks the OSRM route service for the fastest route between from and to.
+func (o OSRM) Route(ctx context.Context, from, to Point) (*Route, error) {
+	baseURL := o.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultOSRMURL
+	}
+	profile := o.Profile
+	if profile == "" {
+		profile = "driving"
+	}
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	url := fmt.Sprintf("%s/route/v1/%s/%f,%f;%f,%f?overview=simplified&geometries=geojson",
+		strings.TrimSuffix(baseURL, "/"), profile, from.Lng, from.Lat, to.Lng, to.Lat)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result osrmResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &StatusError{Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return nil, err
+	}
+
+	switch {
+	case result.Code == "NoRoute":
+		return nil, ErrNoRoute
+	case resp.StatusCode != http.StatusOK:
+		return nil, &StatusError{Code: resp.StatusCode, Message: result.Code + ": " + result.Message}
+	case result.Code != "Ok":
+		return nil, fmt.Errorf("osrm: %s: %s", result.Code, result.Message)
+	case len(result.Routes) == 0:
+		return nil, ErrNoRoute
+	}
+
+	best := result.Routes[0]
+
+	path := make([]Point, 0, len(best.Geometry.Coordinates))
+	for _, c := range best.Geometry.Coordinates {
+		if len(c) < 2 {
+			continue
+		}
+		path = append(path, Point{Lat: c[1], Lng: c[0]})
+	}
+
+	return &Route{
+		Provider: "osrm",
+		Distance: best.Distance,
+		Duration: time.Duration(best.Duration * float64(time.Second)),
+		Path:     path,
+	}, nil
+}
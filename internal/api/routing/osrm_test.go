@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubOSRM starts an OSRM route service that answers every request with the
+// status and body, and records the path of the last request.
+func stubOSRM(t *testing.T, status int, body string) (*httptest.Server, *string) {
+	t.Helper()
+
+	var path string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &path
+}
+
+var (
+	from = Point{Lat: 52.517037, Lng: 13.388860}
+	to   = Point{Lat: 52.529407, Lng: 13.397634}
+)
+
+func TestOSRMRoute(t *testing.T) {
+	srv, path := stubOSRM(t, http.StatusOK, `{
+		"code": "Ok",
+		"routes": [{
+			"distance": 1884.2,
+			"duration": 251.5,
+			"geometry": {"coordinates": [[13.38886, 52.517037], [13.397634, 52.529407]]}
+		}]
+	}`)
+
+	route, err := OSRM{BaseURL: srv.URL + "/"}.Route(context.Background(), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(*path, "/route/v1/driving/13.388860,52.517037;13.397634,52.529407") {
+		t.Errorf("path = %q", *path)
+	}
+	if route.Provider != "osrm" || route.Distance != 1884.2 || route.Duration != 251500*time.Millisecond {
+		t.Errorf("route = %+v", route)
+	}
+	if len(route.Path) != 2 || route.Path[0] != from || route.Path[1] != to {
+		t.Errorf("path = %v", route.Path)
+	}
+}
+
+func TestOSRMRouteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		check  func(error) bool
+	}{
+		{"no route", http.StatusBadRequest, `{"code": "NoRoute", "message": "Impossible route between points"}`, isNoRoute},
+		{"no routes", http.StatusOK, `{"code": "Ok", "routes": []}`, isNoRoute},
+		{"invalid query", http.StatusBadRequest, `{"code": "InvalidQuery", "message": "Query string malformed"}`, hasStatus(http.StatusBadRequest)},
+		{"server error", http.StatusBadGateway, `<html>bad gateway</html>`, hasStatus(http.StatusBadGateway)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := stubOSRM(t, tt.status, tt.body)
+
+			_, err := OSRM{BaseURL: srv.URL}.Route(context.Background(), from, to)
+			if !tt.check(err) {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestFallbackRoute(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		provider string
+		check    func(error) bool
+	}{
+		{"primary ok", http.StatusOK, `{"code": "Ok", "routes": [{"distance": 1, "duration": 1}]}`, "osrm", isNil},
+		{"primary unavailable", http.StatusServiceUnavailable, ``, "straight", isNil},
+		{"primary rate limited", http.StatusTooManyRequests, ``, "straight", isNil},
+		{"no route", http.StatusBadRequest, `{"code": "NoRoute"}`, "", isNoRoute},
+		{"invalid query", http.StatusBadRequest, `{"code": "InvalidQuery"}`, "", hasStatus(http.StatusBadRequest)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := stubOSRM(t, tt.status, tt.body)
+
+			f := Fallback{Primary: OSRM{BaseURL: srv.URL}, Secondary: StraightLine{}}
+
+			route, err := f.Route(context.Background(), from, to)
+			if !tt.check(err) {
+				t.Fatalf("err = %v", err)
+			}
+			if route != nil && route.Provider != tt.provider {
+				t.Errorf("provider = %q, want %q", route.Provider, tt.provider)
+			}
+		})
+	}
+
+	t.Run("primary unreachable", func(t *testing.T) {
+		srv, _ := stubOSRM(t, http.StatusOK, ``)
+		srv.Close()
+
+		f := Fallback{Primary: OSRM{BaseURL: srv.URL}, Secondary: StraightLine{}}
+
+		route, err := f.Route(context.Background(), from, to)
+		if err != nil || route.Provider != "straight" {
+			t.Errorf("route = %+v, err = %v", route, err)
+		}
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		srv, _ := stubOSRM(t, http.StatusOK, ``)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		f := Fallback{Primary: OSRM{BaseURL: srv.URL}, Secondary: StraightLine{}}
+
+		_, err := f.Route(ctx, from, to)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v", err)
+		}
+	})
+}
+
+func isNil(err error) bool {
+	return err == nil
+}
+
+func isNoRoute(err error) bool {
+	return errors.Is(err, ErrNoRoute)
+}
+
+func hasStatus(code int) func(error) bool {
+	return func(err error) bool {
+		var statusErr *StatusError
+		return errors.As(err, &statusErr) && statusErr.Code == code
+	}
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// earthRadius is the mean radius of the earth in meters.
+const earthRadius = 6371008.8
+
+// ErrNoRoute is returned by a Provider when no route exists between two points.
+var ErrNoRoute = errors.New("no route found")
+
+// StatusError is returned by HTTP backed providers when the service answers
+// with a status other than 200 OK.
+type StatusError struct {
+	Code    int    // Code is the HTTP status code.
+	Message string // Message is the error message of the service, if any.
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d: %s", e.Code, e.Message)
+}
+
+// Point is a WGS84 coordinate.
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Route is the result of a routing request.
+type Route struct {
+	Provider string        `json:"provider"` // Provider is the name of the provider that computed the route.
+	Distance float64       `json:"distance"` // Distance is the travel distance in meters.
+	Duration time.Duration `json:"-"`        // Duration is the estimated travel time.
+	Path     []Point       `json:"path"`     // Path is the route geometry, starting at the origin.
+}
+
+// Provider computes travel distance and time between two points.
+type Provider interface {
+	Route(ctx context.Context, from, to Point) (*Route, error)
+}
+
+// Distance returns the great-circle distance in meters between two points.
+func Distance(a, b Point) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Fallback is a Provider that asks Primary first and falls back to Secondary
+// when Primary is unavailable.
+type Fallback struct {
+	Primary   Provider
+	Secondary Provider
+}
+
+// Route returns the Primary route, or the Secondary route if Primary could
+// not be reached or failed with a 5xx status. Other errors, such as
+// ErrNoRoute or the context ending, are returned as they are.
+func (f Fallback) Route(ctx context.Context, from, to Point) (*Route, error) {
+	route, err := f.Primary.Route(ctx, from, to)
+	if err == nil || !unavailable(ctx, err) {
+		return route, err
+	}
+	return f.Secondary.Route(ctx, from, to)
+}
+
+// unavailable reports whether err means the provider could not answer, such
+// as a server error or a rate limit, as opposed to an answer that another
+// provider would not change.
+func unavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrNoRoute) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
@@ -0,0 +1,34 @@
+package routing
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultSpeed is the average travel speed, in km/h, used by StraightLine
+// when none is configured.
+const DefaultSpeed = 40.0
+
+// StraightLine is a Provider that estimates travel as a direct line between
+// the two points at a constant average speed.
+type StraightLine struct {
+	Speed float64 // Speed is the average travel speed in km/h.
+}
+
+// Route returns the straight-line route between from and to.
+func (s StraightLine) Route(ctx context.Context, from, to Point) (*Route, error) {
+	speed := s.Speed
+	if speed <= 0 {
+		speed = DefaultSpeed
+	}
+
+	distance := Distance(from, to)
+	hours := distance / 1000 / speed
+
+	return &Route{
+		Provider: "straight",
+		Distance: distance,
+		Duration: time.Duration(hours * float64(time.Hour)),
+		Path:     []Point{from, to},
+	}, nil
+}
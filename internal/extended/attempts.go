@@ -0,0 +1,145 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AttemptPolicy limits the failed attempts of a key, such as an email
+// address or an IP address.
+type AttemptPolicy struct {
+	// Delay is the number of failures after which each attempt must wait
+	// twice as long as the previous one, starting at a second.
+	Delay int
+	// MaxDelay caps the wait between attempts.
+	MaxDelay time.Duration
+	// Threshold is the number of failures that lock the key.
+	Threshold int
+	// Lockout is how long a locked key is refused.
+	Lockout time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+// wait returns how long the key must wait after its last failure.
+func (p AttemptPolicy) wait(failures int) time.Duration {
+	if failures < p.Delay {
+		return 0
+	}
+
+	n := min(failures-p.Delay, 30)
+
+	return min(time.Second<<n, p.MaxDelay)
+}
+
+type AttemptModel struct {
+	DB *sql.DB
+}
+
+// Reserve counts an attempt of the key before it is known to fail, so that
+// concurrent attempts cannot get past the policy. It returns how long the key
+// must wait instead, without counting the attempt, and reports whether the
+// failures so far locked the key. Failures start over once the lockout ends.
+func (m AttemptModel) Reserve(key string, p AttemptPolicy) (time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Forget the keys nobody tried in a while.
+	_, err = tx.ExecContext(ctx, `
+	DELETE FROM auth_attempts
+	WHERE last_failed_at < NOW() - $1::float8 * interval '1 second' AND (locked_until IS NULL OR locked_until < NOW())`,
+		p.Window.Seconds())
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO auth_attempts (key) VALUES ($1) ON CONFLICT (key) DO NOTHING`, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// The row lock makes concurrent attempts of the key wait for this one.
+	query := `
+	SELECT failures, last_failed_at, locked_until
+	FROM auth_attempts
+	WHERE key = $1
+	FOR UPDATE`
+
+	var (
+		failures     int
+		lastFailedAt time.Time
+		lockedUntil  sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, key).Scan(&failures, &lastFailedAt, &lockedUntil)
+	if err != nil {
+		return 0, false, err
+	}
+
+	now := time.Now()
+
+	if lockedUntil.Valid {
+		if now.Before(lockedUntil.Time) {
+			return lockedUntil.Time.Sub(now), false, nil
+		}
+		failures = 0
+	}
+
+	if now.Sub(lastFailedAt) > p.Window {
+		failures = 0
+	}
+
+	if failures >= p.Threshold {
+		_, err = tx.ExecContext(ctx, `UPDATE auth_attempts SET locked_until = $2 WHERE key = $1`, key, now.Add(p.Lockout))
+		if err != nil {
+			return 0, false, err
+		}
+		return p.Lockout, true, tx.Commit()
+	}
+
+	if failures > 0 {
+		if wait := lastFailedAt.Add(p.wait(failures)).Sub(now); wait > 0 {
+			return wait, false, nil
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE auth_attempts
+	SET failures = $2, last_failed_at = NOW(), locked_until = NULL
+	WHERE key = $1`, key, failures+1)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return 0, false, tx.Commit()
+}
+
+// Release takes back an attempt of the key that turned out to succeed.
+func (m AttemptModel) Release(key string) error {
+	query := `
+	UPDATE auth_attempts
+	SET failures = GREATEST(failures - 1, 0)
+	WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Reset forgets the failed attempts of the key.
+func (m AttemptModel) Reset(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM auth_attempts WHERE key = $1`, key)
+	return err
+}
@@ -14,6 +14,16 @@ type Extended struct {
 	Vendors   VendorModel
 	Contents  ContentModel
 	Addresses AddressModel
+
+	RefreshTokens RefreshTokenModel
+	Sessions      SessionModel
+	Profiles      ProfileModel
+	PhoneCodes    PhoneCodeModel
+	Roles         RoleModel
+	OAuthStates   OAuthStateModel
+	Identities    IdentityModel
+	TwoFactor     TwoFactorModel
+	Attempts      AttemptModel
 }
 
 func NewExtended(db *sql.DB) Extended {
@@ -21,5 +31,15 @@ func NewExtended(db *sql.DB) Extended {
 		Vendors:   VendorModel{DB: db},
 		Contents:  ContentModel{DB: db},
 		Addresses: AddressModel{DB: db},
+
+		RefreshTokens: RefreshTokenModel{DB: db},
+		Sessions:      SessionModel{DB: db},
+		Profiles:      ProfileModel{DB: db},
+		PhoneCodes:    PhoneCodeModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		OAuthStates:   OAuthStateModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		TwoFactor:     TwoFactorModel{DB: db},
+		Attempts:      AttemptModel{DB: db},
 	}
 }
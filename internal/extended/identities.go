@@ -0,0 +1,195 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+)
+
+// StateTTL is how long a user has to sign in with an identity provider.
+const StateTTL = 10 * time.Minute
+
+var (
+	ErrInvalidState   = errors.New("invalid or expired state")
+	ErrIdentityLinked = errors.New("identity linked to another user")
+)
+
+type OAuthStateModel struct {
+	DB *sql.DB
+}
+
+// New stores the PKCE verifier of a sign-in with the provider, and returns
+// the state the provider hands back with the authorization code. userID is 0
+// for a sign-in, or the user the identity is to be linked to.
+func (m OAuthStateModel) New(provider string, userID int64, verifier string) (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	state := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM oauth_states WHERE expiry < NOW()`)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+	INSERT INTO oauth_states (hash, provider, verifier, user_id, expiry)
+	VALUES ($1, $2, $3, NULLIF($4::bigint, 0), $5)`
+
+	_, err = tx.ExecContext(ctx, query, hash[:], provider, verifier, userID, time.Now().Add(StateTTL))
+	if err != nil {
+		return "", err
+	}
+
+	return state, tx.Commit()
+}
+
+// Consume uses up the state and returns its verifier. The state must have
+// been created for the same provider and user, so a state created to link an
+// identity cannot be used to sign in, and the other way round.
+func (m OAuthStateModel) Consume(state, provider string, userID int64) (string, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `
+	DELETE FROM oauth_states
+	WHERE hash = $1 AND provider = $2 AND user_id IS NOT DISTINCT FROM NULLIF($3::bigint, 0) AND expiry > NOW()
+	RETURNING verifier`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var verifier string
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider, userID).Scan(&verifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrInvalidState
+		default:
+			return "", err
+		}
+	}
+
+	return verifier, nil
+}
+
+// Identity is a user account at an identity provider linked to a user.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"-"`
+	UserID    int64     `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// GetUserID returns the user the identity is linked to.
+func (m IdentityModel) GetUserID(provider, subject string) (int64, error) {
+	query := `
+	SELECT user_id
+	FROM user_identities
+	WHERE provider = $1 AND subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// Insert links the identity to its user. Linking it again to the same user
+// only updates its email; it returns ErrIdentityLinked when the identity is
+// linked to another user.
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+	INSERT INTO user_identities (provider, subject, user_id, email)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (provider, subject) DO UPDATE
+	SET email = EXCLUDED.email
+	WHERE user_identities.user_id = EXCLUDED.user_id
+	RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, identity.Provider, identity.Subject, identity.UserID, identity.Email).Scan(&identity.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrIdentityLinked
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForUser returns the identities linked to the user.
+func (m IdentityModel) GetAllForUser(userID int64) ([]*Identity, error) {
+	query := `
+	SELECT provider, subject, user_id, email, created_at
+	FROM user_identities
+	WHERE user_id = $1
+	ORDER BY created_at, provider`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
@@ -0,0 +1,198 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pistolricks/validation"
+)
+
+// Purposes of the one-time codes sent to phones.
+const (
+	PurposePhoneVerification = "phone-verification"
+	PurposePhoneLogin        = "phone-login"
+)
+
+const (
+	// CodeTTL is how long a one-time code can be used.
+	CodeTTL = 10 * time.Minute
+
+	// MaxCodeAttempts is the number of wrong guesses after which a code is
+	// discarded.
+	MaxCodeAttempts = 5
+
+	// codeResendInterval is how long a user must wait before a new code for
+	// the same purpose is sent.
+	codeResendInterval = time.Minute
+)
+
+var (
+	ErrInvalidCode   = errors.New("invalid or expired code")
+	ErrCodeThrottled = errors.New("code requested too recently")
+)
+
+func ValidatePhone(v *validation.Validator, phone string) {
+	v.Check(phone != "", "phone", "must be provided")
+	v.Check(validation.Matches(phone, PhoneRX), "phone", "must be an international number such as +15551234567")
+}
+
+func ValidateCode(v *validation.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+type PhoneCodeModel struct {
+	DB *sql.DB
+}
+
+// New starts a code of the purpose for the phone of the user, replacing the
+// previous one. The code itself is only created by Issue when it is sent, so
+// its plaintext never has to be stored. It returns ErrCodeThrottled when the
+// previous code was started less than a minute ago.
+func (m PhoneCodeModel) New(userID int64, phone, purpose string) error {
+	// Nothing matches the hash until Issue replaces it.
+	unused := make([]byte, 32)
+	_, err := rand.Read(unused)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(unused)
+
+	query := `
+	INSERT INTO phone_codes (user_id, purpose, phone, hash, expiry)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (user_id, purpose) DO UPDATE
+	SET created_at = NOW(), phone = EXCLUDED.phone, hash = EXCLUDED.hash, expiry = EXCLUDED.expiry, attempts = 0
+	WHERE phone_codes.created_at < NOW() - $6::float8 * interval '1 second'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, purpose, phone, hash[:], time.Now().Add(CodeTTL), codeResendInterval.Seconds())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrCodeThrottled
+	}
+
+	return nil
+}
+
+// Issue creates the code of the purpose started for the user, and returns
+// its plaintext with the phone to send it to. Each call replaces the code,
+// so a retried send gets a fresh one. It returns ErrRecordNotFound when no
+// code was started or it expired.
+func (m PhoneCodeModel) Issue(userID int64, purpose string) (string, string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", "", err
+	}
+
+	code := fmt.Sprintf("%06d", n.Int64())
+	hash := sha256.Sum256([]byte(code))
+
+	query := `
+	UPDATE phone_codes
+	SET hash = $3, expiry = $4, attempts = 0
+	WHERE user_id = $1 AND purpose = $2 AND expiry > NOW()
+	RETURNING phone`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var phone string
+
+	err = m.DB.QueryRowContext(ctx, query, userID, purpose, hash[:], time.Now().Add(CodeTTL)).Scan(&phone)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", "", ErrRecordNotFound
+		default:
+			return "", "", err
+		}
+	}
+
+	return code, phone, nil
+}
+
+// Verify checks the code of the purpose for the user and returns the phone
+// it was sent to. A matching code is used up; a wrong one counts as an
+// attempt, and the code is discarded after MaxCodeAttempts of them.
+func (m PhoneCodeModel) Verify(userID int64, purpose, code string) (string, error) {
+	query := `
+	SELECT phone, hash, expiry, attempts
+	FROM phone_codes
+	WHERE user_id = $1 AND purpose = $2
+	FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		phone    string
+		hash     []byte
+		expiry   time.Time
+		attempts int
+	)
+
+	err = tx.QueryRowContext(ctx, query, userID, purpose).Scan(&phone, &hash, &expiry, &attempts)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrInvalidCode
+		default:
+			return "", err
+		}
+	}
+
+	if time.Now().After(expiry) || attempts >= MaxCodeAttempts {
+		return "", ErrInvalidCode
+	}
+
+	sum := sha256.Sum256([]byte(code))
+
+	if subtle.ConstantTimeCompare(sum[:], hash) != 1 {
+		if attempts+1 >= MaxCodeAttempts {
+			_, err = tx.ExecContext(ctx, `DELETE FROM phone_codes WHERE user_id = $1 AND purpose = $2`, userID, purpose)
+		} else {
+			_, err = tx.ExecContext(ctx, `UPDATE phone_codes SET attempts = attempts + 1 WHERE user_id = $1 AND purpose = $2`, userID, purpose)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return "", err
+		}
+
+		return "", ErrInvalidCode
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM phone_codes WHERE user_id = $1 AND purpose = $2`, userID, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	return phone, tx.Commit()
+}
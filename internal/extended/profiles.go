@@ -0,0 +1,399 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+	"github.com/pistolricks/validation"
+)
+
+var (
+	ErrDuplicateEmail    = errors.New("duplicate email")
+	ErrDuplicateUsername = errors.New("duplicate username")
+	ErrDuplicatePhone    = errors.New("duplicate phone")
+)
+
+// ScopeEmailChange is the scope of the tokens sent to the new email address
+// of a user, to confirm it.
+const ScopeEmailChange = "email-change"
+
+var (
+	UsernameRX = regexp.MustCompile(`^[a-zA-Z0-9_.]{3,30}$`)
+	// PhoneRX matches E.164 phone numbers.
+	PhoneRX = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// Profile is the user as seen by the user themselves, with the profile
+// fields the models package does not know about.
+type Profile struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	// PendingEmail is the address the user is changing Email to. It takes
+	// over once confirmed with the token sent to it.
+	PendingEmail string `json:"pending_email,omitempty"`
+	Phone        string `json:"phone"`
+	// PhoneVerified is reset whenever the phone changes.
+	PhoneVerified bool `json:"phone_verified"`
+	Activated     bool `json:"activated"`
+	Version       int  `json:"version"`
+}
+
+func ValidateProfile(v *validation.Validator, profile *Profile) {
+	v.Check(profile.Name != "", "name", "must be provided")
+	v.Check(len(profile.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(len(profile.FirstName) <= 500, "first_name", "must not be more than 500 bytes long")
+	v.Check(len(profile.LastName) <= 500, "last_name", "must not be more than 500 bytes long")
+
+	if profile.Username != "" {
+		v.Check(validation.Matches(profile.Username, UsernameRX), "username", "must be 3 to 30 letters, digits, dots or underscores")
+	}
+	if profile.Phone != "" {
+		v.Check(validation.Matches(profile.Phone, PhoneRX), "phone", "must be an international number such as +15551234567")
+	}
+
+	models.ValidateEmail(v, profile.Email)
+	if profile.PendingEmail != "" {
+		models.ValidateEmail(v, profile.PendingEmail)
+	}
+}
+
+type ProfileModel struct {
+	DB *sql.DB
+}
+
+// Get returns the profile of a user that was not deleted.
+func (m ProfileModel) Get(id int64) (*Profile, error) {
+	query := `
+	SELECT id, created_at, name, first_name, last_name, COALESCE(username, ''), email, COALESCE(pending_email, ''), COALESCE(phone, ''), phone_verified_at IS NOT NULL, activated, version
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	return m.get(query, id)
+}
+
+// GetByPhone returns the profile of the user who verified the phone.
+func (m ProfileModel) GetByPhone(phone string) (*Profile, error) {
+	query := `
+	SELECT id, created_at, name, first_name, last_name, COALESCE(username, ''), email, COALESCE(pending_email, ''), COALESCE(phone, ''), phone_verified_at IS NOT NULL, activated, version
+	FROM users
+	WHERE phone = $1 AND phone_verified_at IS NOT NULL AND deleted_at IS NULL`
+
+	return m.get(query, phone)
+}
+
+func (m ProfileModel) get(query string, args ...any) (*Profile, error) {
+	var profile Profile
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&profile.ID,
+		&profile.CreatedAt,
+		&profile.Name,
+		&profile.FirstName,
+		&profile.LastName,
+		&profile.Username,
+		&profile.Email,
+		&profile.PendingEmail,
+		&profile.Phone,
+		&profile.PhoneVerified,
+		&profile.Activated,
+		&profile.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &profile, nil
+}
+
+// Update saves the profile if its version is still the stored one, and
+// bumps the version.
+func (m ProfileModel) Update(profile *Profile) error {
+	query := `
+	UPDATE users
+	SET name = $1, first_name = $2, last_name = $3, username = NULLIF($4, ''), email = $5, phone = NULLIF($6, ''), activated = $7, pending_email = NULLIF($8, ''), version = version + 1,
+	phone_verified_at = CASE WHEN phone IS NOT DISTINCT FROM NULLIF($6, '') THEN phone_verified_at END
+	WHERE id = $9 AND version = $10 AND deleted_at IS NULL
+	RETURNING version, phone_verified_at IS NOT NULL`
+
+	args := []any{
+		profile.Name,
+		profile.FirstName,
+		profile.LastName,
+		profile.Username,
+		profile.Email,
+		profile.Phone,
+		profile.Activated,
+		profile.PendingEmail,
+		profile.ID,
+		profile.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&profile.Version, &profile.PhoneVerified)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "users_email_key":
+			return ErrDuplicateEmail
+		case errors.As(err, &pqErr) && pqErr.Constraint == "users_username_key":
+			return ErrDuplicateUsername
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConfirmEmail replaces the email address of the user with their pending
+// one, which they proved they own, and activates the account. It returns
+// ErrDuplicateEmail when another user registered the address meanwhile.
+func (m ProfileModel) ConfirmEmail(id int64) error {
+	query := `
+	UPDATE users
+	SET email = pending_email, pending_email = NULL, activated = true, ever_activated = true, version = version + 1
+	WHERE id = $1 AND pending_email IS NOT NULL AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "users_email_key":
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// VerifyPhone marks the phone as verified, if it is still the user's. The
+// user takes the number over: it is removed from any other user who has it,
+// since it has obviously changed hands. It returns ErrDuplicatePhone when
+// another user verified the number at the same time.
+func (m ProfileModel) VerifyPhone(id int64, phone string) error {
+	query := `
+	UPDATE users
+	SET phone_verified_at = NOW(), version = version + 1
+	WHERE id = $1 AND phone = $2 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE users
+	SET phone = NULL, phone_verified_at = NULL, version = version + 1
+	WHERE phone = $2 AND id <> $1 AND deleted_at IS NULL`, id, phone)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, query, id, phone)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "users_phone_key":
+			return ErrDuplicatePhone
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return tx.Commit()
+}
+
+// Delete soft-deletes the user: the row is kept, but the user can no
+// longer sign in. Their email address is given up, so it can be registered
+// again; the models package looks users up by email without knowing about
+// deleted ones, so the address cannot stay on the row.
+func (m ProfileModel) Delete(id int64) error {
+	query := `
+	UPDATE users
+	SET deleted_at = NOW(), activated = false, email = 'deleted-' || id || '@deleted.invalid', pending_email = NULL, version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Reclaimable reports whether the user never activated their account, so
+// that it may be reclaimed.
+func (m ProfileModel) Reclaimable(id int64) (bool, error) {
+	query := `
+	SELECT NOT ever_activated
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reclaimable bool
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&reclaimable)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return reclaimable, nil
+}
+
+// Reclaim activates a user who never activated their account, on behalf of
+// the owner of their email address, and discards whatever was set up on the
+// account before: its sessions and tokens, phone, second factor and linked
+// identities. Whoever registered the email address first keeps no way in.
+// It returns ErrRecordNotFound for accounts that were ever activated.
+func (m ProfileModel) Reclaim(id int64) error {
+	query := `
+	UPDATE users
+	SET activated = true, ever_activated = true, phone = NULL, phone_verified_at = NULL, pending_email = NULL, version = version + 1
+	WHERE id = $1 AND NOT ever_activated AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	for _, table := range []string{"tokens", "sessions", "phone_codes", "two_factor", "recovery_codes", "user_identities"} {
+		_, err = tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Export returns the data stored about the user, other than their profile,
+// as a JSON document.
+func (m ProfileModel) Export(id int64) (json.RawMessage, error) {
+	query := `
+	SELECT json_build_object(
+		'contents', COALESCE((
+			SELECT json_agg(json_build_object(
+				'created_at', created_at, 'name', name, 'original', original, 'src', src, 'type', type, 'size', size
+			) ORDER BY id)
+			FROM contents WHERE user_id = $1
+		), '[]'),
+		'messages', COALESCE((
+			SELECT json_agg(json_build_object(
+				'id', id, 'created_at', created_at, 'room', room, 'conversation_id', conversation_id, 'params', params
+			) ORDER BY id)
+			FROM messages WHERE user_id = $1
+		), '[]'),
+		'sessions', COALESCE((
+			SELECT json_agg(json_build_object(
+				'created_at', created_at, 'last_used_at', last_used_at, 'ip', ip, 'user_agent', user_agent
+			) ORDER BY id)
+			FROM sessions WHERE user_id = $1
+		), '[]'),
+		'blocks', COALESCE((
+			SELECT json_agg(json_build_object('user_id', blocked_id, 'created_at', created_at))
+			FROM user_blocks WHERE user_id = $1
+		), '[]')
+	)`
+
+	var export json.RawMessage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&export)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
@@ -0,0 +1,236 @@
+package extended
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// Role codes. The permissions of each role are stored in roles_permissions.
+const (
+	RoleCustomer  = "customer"
+	RoleVendor    = "vendor"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+type Role struct {
+	Code        string   `json:"code"`
+	Permissions []string `json:"permissions"`
+}
+
+// UserRole is a role granted to a user.
+type UserRole struct {
+	Code      string    `json:"code"`
+	GrantedAt time.Time `json:"granted_at"`
+	GrantedBy *int64    `json:"granted_by"`
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// GetAll returns the roles with their permissions.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+	SELECT roles.code, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+	FROM roles
+	LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+	LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+	GROUP BY roles.id
+	ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.Code, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetAllForUser returns the roles granted to the user.
+func (m RoleModel) GetAllForUser(userID int64) ([]*UserRole, error) {
+	query := `
+	SELECT roles.code, users_roles.granted_at, users_roles.granted_by
+	FROM users_roles
+	INNER JOIN roles ON roles.id = users_roles.role_id
+	WHERE users_roles.user_id = $1
+	ORDER BY roles.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*UserRole{}
+
+	for rows.Next() {
+		var role UserRole
+
+		err := rows.Scan(&role.Code, &role.GrantedAt, &role.GrantedBy)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetPermissionsForUser returns the permissions granted to the user directly
+// and through their roles.
+func (m RoleModel) GetPermissionsForUser(userID int64) (models.Permissions, error) {
+	query := `
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+	WHERE users_permissions.user_id = $1
+	UNION
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+	WHERE users_roles.user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions models.Permissions
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// AddForUser grants the role to the user. grantedBy is 0 for roles granted
+// by the system, such as on registration. It returns ErrRecordNotFound when
+// the role or the user does not exist.
+func (m RoleModel) AddForUser(userID int64, code string, grantedBy int64) error {
+	query := `
+	INSERT INTO users_roles (user_id, role_id, granted_by)
+	SELECT $1, roles.id, NULLIF($3::bigint, 0)
+	FROM roles
+	WHERE roles.code = $2
+	ON CONFLICT DO NOTHING
+	RETURNING role_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roleID int64
+
+	err := m.DB.QueryRowContext(ctx, query, userID, code, grantedBy).Scan(&roleID)
+	if err != nil {
+		var pqErr *pq.Error
+
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return ErrRecordNotFound
+		case errors.Is(err, sql.ErrNoRows):
+			// Either the role does not exist or the user already has it.
+			return m.exists(ctx, code)
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveForUser revokes the role from the user.
+func (m RoleModel) RemoveForUser(userID int64, code string) error {
+	query := `
+	DELETE FROM users_roles
+	USING roles
+	WHERE roles.id = users_roles.role_id
+	AND users_roles.user_id = $1
+	AND roles.code = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, code)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// exists returns ErrRecordNotFound unless the role exists.
+func (m RoleModel) exists(ctx context.Context, code string) error {
+	var exists bool
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE code = $1)`, code).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
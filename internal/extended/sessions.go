@@ -0,0 +1,156 @@
+package extended
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// touchInterval is how stale last_used_at must be before a request updates
+// it, so that a busy client does not write on every request.
+const touchInterval = time.Minute
+
+// Session is a login, which lasts as long as its token family can be
+// refreshed.
+type Session struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// Touch records the use of the session of an authentication token.
+func (m SessionModel) Touch(tokenPlaintext, ip, userAgent string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	UPDATE sessions
+	SET last_used_at = NOW(), ip = $3, user_agent = $4
+	FROM tokens
+	WHERE tokens.hash = $1
+	AND tokens.family = sessions.id
+	AND sessions.last_used_at < NOW() - $2::float8 * interval '1 second'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash[:], touchInterval.Seconds(), ip, userAgent)
+	return err
+}
+
+// GetAllForUser returns the sessions of the user that can still be used,
+// flagging the one the authentication token belongs to as current.
+func (m SessionModel) GetAllForUser(userID int64, tokenPlaintext string) ([]*Session, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT s.id, s.created_at, s.last_used_at, s.ip, s.user_agent,
+	EXISTS (SELECT 1 FROM tokens WHERE hash = $2 AND family = s.id)
+	FROM sessions s
+	WHERE s.user_id = $1
+	AND EXISTS (
+		SELECT 1 FROM tokens t
+		WHERE t.family = s.id AND t.expiry > NOW() AND t.used_at IS NULL
+	)
+	ORDER BY s.last_used_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		session := Session{UserID: userID}
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteForToken ends the session of an authentication token, deleting all
+// the tokens of its family. A token issued without a session is deleted on
+// its own.
+func (m SessionModel) DeleteForToken(tokenPlaintext string) error {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var family sql.NullInt64
+
+	err := m.DB.QueryRowContext(ctx, `DELETE FROM tokens WHERE hash = $1 RETURNING family`, hash[:]).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if !family.Valid {
+		return nil
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, family.Int64)
+	return err
+}
+
+// DeleteAllForUser ends every session of the user and deletes all their
+// authentication and refresh tokens.
+func (m SessionModel) DeleteAllForUser(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope IN ($2, $3)`, userID, models.ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
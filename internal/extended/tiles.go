@@ -0,0 +1,108 @@
+package extended
+
+import (
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	// VendorLayer is the name of the vector tile layer holding vendor points.
+	VendorLayer = "vendors"
+
+	// ClusterMaxZoom is the highest zoom level at which nearby vendors are
+	// merged into a single cluster point.
+	ClusterMaxZoom = 13
+
+	// clusterRadius is the size, in tile extent units, of the grid cells used
+	// to group vendors into clusters.
+	clusterRadius = 256
+)
+
+// VendorTile encodes the given vendor locations into a Mapbox Vector Tile for
+// the given tile. Below ClusterMaxZoom, vendors sharing a grid cell are merged
+// into a single point carrying a point_count property.
+func VendorTile(tile maptile.Tile, locations []*VendorLocation) ([]byte, error) {
+	fc := geojson.NewFeatureCollection()
+
+	if tile.Z <= ClusterMaxZoom {
+		for _, f := range clusterVendors(tile, locations) {
+			fc.Append(f)
+		}
+	} else {
+		for _, location := range locations {
+			fc.Append(vendorFeature(location))
+		}
+	}
+
+	layers := mvt.Layers{mvt.NewLayer(VendorLayer, fc)}
+	layers.ProjectToTile(tile)
+	layers.Clip(mvt.MapboxGLDefaultExtentBound)
+
+	return mvt.Marshal(layers)
+}
+
+func vendorFeature(location *VendorLocation) *geojson.Feature {
+	f := geojson.NewFeature(orb.Point{location.Lng, location.Lat})
+	f.ID = location.ID
+	f.Properties["id"] = location.ID
+	f.Properties["name"] = location.Name
+	f.Properties["category"] = location.Category
+
+	return f
+}
+
+func clusterVendors(tile maptile.Tile, locations []*VendorLocation) []*geojson.Feature {
+	type cluster struct {
+		members  []*VendorLocation
+		lat, lng float64
+	}
+
+	var (
+		order    []int64
+		clusters = make(map[int64]*cluster)
+		cells    = int64(mvt.DefaultExtent / clusterRadius)
+	)
+
+	for _, location := range locations {
+		p := maptile.Fraction(orb.Point{location.Lng, location.Lat}, tile.Z)
+
+		cx := int64(math.Floor((p[0] - float64(tile.X)) * float64(cells)))
+		cy := int64(math.Floor((p[1] - float64(tile.Y)) * float64(cells)))
+		key := (cy+1)*(cells+2) + (cx + 1)
+
+		c, ok := clusters[key]
+		if !ok {
+			c = &cluster{}
+			clusters[key] = c
+			order = append(order, key)
+		}
+
+		c.members = append(c.members, location)
+		c.lat += location.Lat
+		c.lng += location.Lng
+	}
+
+	features := make([]*geojson.Feature, 0, len(order))
+
+	for _, key := range order {
+		c := clusters[key]
+
+		if len(c.members) == 1 {
+			features = append(features, vendorFeature(c.members[0]))
+			continue
+		}
+
+		n := float64(len(c.members))
+		f := geojson.NewFeature(orb.Point{c.lng / n, c.lat / n})
+		f.Properties["cluster"] = true
+		f.Properties["point_count"] = len(c.members)
+
+		features = append(features, f)
+	}
+
+	return features
+}
@@ -0,0 +1,192 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"time"
+
+	"github.com/pistolricks/models/cmd/models"
+)
+
+// ScopeRefresh is the scope of the long-lived tokens exchanged for a new
+// access token on /v1/tokens/refresh.
+const ScopeRefresh = "refresh"
+
+// ErrTokenReused is returned when a refresh token that was already rotated
+// is presented again, which means it leaked.
+var ErrTokenReused = errors.New("refresh token reused")
+
+// TokenPair is a short-lived access token and the refresh token used to
+// renew it. Tokens renewed from the same login share a family, which is the
+// ID of the session created by the login.
+type TokenPair struct {
+	Access  *models.Token `json:"authentication_token"`
+	Refresh *models.Token `json:"refresh_token"`
+	UserID  int64         `json:"-"`
+	Family  int64         `json:"-"`
+}
+
+type RefreshTokenModel struct {
+	DB *sql.DB
+}
+
+// Issue stores the session, which starts a new token family, and returns
+// its first pair.
+func (m RefreshTokenModel) Issue(session *Session, accessTTL, refreshTTL time.Duration) (*TokenPair, error) {
+	query := `
+	INSERT INTO sessions (user_id, ip, user_agent)
+	VALUES ($1, $2, $3)
+	RETURNING id, created_at, last_used_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, session.UserID, session.IP, session.UserAgent).Scan(&session.ID, &session.CreatedAt, &session.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := insertPair(ctx, tx, session.UserID, session.ID, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, tx.Commit()
+}
+
+// Rotate exchanges a refresh token for a new pair of the same family. The
+// presented token is marked used rather than deleted, so presenting it again
+// is detected: the session, and with it the whole family, is then deleted
+// and ErrTokenReused returned along with a pair holding only the user and
+// family that were revoked.
+func (m RefreshTokenModel) Rotate(tokenPlaintext string, accessTTL, refreshTTL time.Duration) (*TokenPair, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+	SELECT user_id, family, expiry, used_at
+	FROM tokens
+	WHERE hash = $1 AND scope = $2
+	FOR UPDATE`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID int64
+		family int64
+		expiry time.Time
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, hash[:], ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, family)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		return &TokenPair{UserID: userID, Family: family}, ErrTokenReused
+	}
+
+	if time.Now().After(expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := insertPair(ctx, tx, userID, family, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, tx.Commit()
+}
+
+// insertPair stores a new access and refresh token of the family.
+func insertPair(ctx context.Context, tx *sql.Tx, userID, family int64, accessTTL, refreshTTL time.Duration) (*TokenPair, error) {
+	query := `
+	INSERT INTO tokens (hash, user_id, expiry, scope, family)
+	VALUES ($1, $2, $3, $4, $5)`
+
+	pair := &TokenPair{UserID: userID, Family: family}
+
+	for _, t := range []struct {
+		dst   **models.Token
+		ttl   time.Duration
+		scope string
+	}{
+		{&pair.Access, accessTTL, models.ScopeAuthentication},
+		{&pair.Refresh, refreshTTL, ScopeRefresh},
+	} {
+		token, err := generateToken(userID, t.ttl, t.scope)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, family)
+		if err != nil {
+			return nil, err
+		}
+
+		*t.dst = token
+	}
+
+	return pair, nil
+}
+
+// generateToken creates a token in the same format as the models package,
+// so it passes models.ValidateTokenPlaintext.
+func generateToken(userID int64, ttl time.Duration, scope string) (*models.Token, error) {
+	token := &models.Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl),
+		Scope:  scope,
+	}
+
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
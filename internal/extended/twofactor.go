@@ -0,0 +1,334 @@
+package extended
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ScopeTwoFactor is the scope of the tokens handed out after the password of
+// a user with two-factor authentication was checked, and exchanged with a
+// code for an authentication token on /v1/tokens/two-factor.
+const ScopeTwoFactor = "two-factor"
+
+// RecoveryCodeCount is the number of recovery codes a user gets.
+const RecoveryCodeCount = 10
+
+var ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+
+// TwoFactor is the TOTP secret of a user. It only protects the account once
+// confirmed with a code from the authenticator app.
+type TwoFactor struct {
+	UserID    int64
+	Secret    string
+	Confirmed bool
+	// LastStep is the time step of the last code used, so a code cannot be
+	// used twice.
+	LastStep int64
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get returns the TOTP secret of the user.
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+	SELECT user_id, secret, confirmed_at IS NOT NULL, last_step
+	FROM two_factor
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.UserID, &tf.Secret, &tf.Confirmed, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &tf, nil
+}
+
+// Enabled reports whether the user confirmed two-factor authentication.
+func (m TwoFactorModel) Enabled(userID int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM two_factor WHERE user_id = $1 AND confirmed_at IS NOT NULL)`, userID).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+
+	return enabled, nil
+}
+
+// Enroll stores a new secret for the user, replacing an unconfirmed one. It
+// returns ErrTwoFactorEnabled when the user already confirmed one.
+func (m TwoFactorModel) Enroll(userID int64, secret string) error {
+	query := `
+	INSERT INTO two_factor (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET created_at = NOW(), secret = EXCLUDED.secret, last_step = 0, attempts = 0
+	WHERE two_factor.confirmed_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// Confirm enables two-factor authentication with the step of the first code
+// the user entered, and returns their recovery codes.
+func (m TwoFactorModel) Confirm(userID, step int64) ([]string, error) {
+	query := `
+	UPDATE two_factor
+	SET confirmed_at = NOW(), last_step = $2
+	WHERE user_id = $1 AND confirmed_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// Use records that a code of the step was used. It returns ErrInvalidCode
+// when a code of that step, or of a later one, was already used.
+func (m TwoFactorModel) Use(userID, step int64) error {
+	query := `
+	UPDATE two_factor
+	SET last_step = $2, attempts = 0
+	WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInvalidCode
+	}
+
+	return nil
+}
+
+// Fail counts a wrong code, and reports whether it was the last one of
+// MaxCodeAttempts, in which case the count starts over.
+func (m TwoFactorModel) Fail(userID int64) (bool, error) {
+	query := `
+	UPDATE two_factor
+	SET attempts = CASE WHEN attempts + 1 >= $2 THEN 0 ELSE attempts + 1 END
+	WHERE user_id = $1
+	RETURNING attempts = 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exhausted bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID, MaxCodeAttempts).Scan(&exhausted)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return exhausted, nil
+}
+
+// UseRecoveryCode uses up one of the user's recovery codes. It returns
+// ErrInvalidCode when the user has no such code.
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) error {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1 AND hash = $2`, userID, hash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInvalidCode
+	}
+
+	_, err = m.DB.ExecContext(ctx, `UPDATE two_factor SET attempts = 0 WHERE user_id = $1`, userID)
+	return err
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and returns new
+// ones.
+func (m TwoFactorModel) ReplaceRecoveryCodes(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// Delete disables two-factor authentication for the user and discards their
+// recovery codes.
+func (m TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM two_factor WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes stores new recovery codes for the user in place of
+// the old ones, and returns them. Only their hashes are stored.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		codes[i] = code[:8] + "-" + code[8:]
+
+		hash := sha256.Sum256([]byte(code))
+		hashes[i] = hash[:]
+	}
+
+	query := `
+	INSERT INTO recovery_codes (user_id, hash)
+	SELECT $1, unnest($2::bytea[])`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.ByteaArray(hashes))
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode drops the case and separators of a recovery code as
+// the user typed it.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ':
+			return -1
+		default:
+			return r
+		}
+	}, strings.ToLower(code))
+}
@@ -17,9 +17,19 @@ type Vendor struct {
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
+	AddressID string    `json:"address_id,omitempty"`
+	UserID    int64     `json:"user_id,omitempty"` // UserID is the user who runs the vendor, 0 when unknown.
 	Version   int32     `json:"version"`
 }
 
+type VendorLocation struct {
+	ID       int64   `json:"id"`
+	Name     string  `json:"name"`
+	Category string  `json:"category"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+}
+
 func ValidateVendor(v *validation.Validator, vendor *Vendor) {
 	v.Check(vendor.Title != "", "title", "is required")
 
@@ -42,11 +52,11 @@ type VendorModel struct {
 
 func (m VendorModel) Insert(vendor *Vendor) error {
 	query := `
-	INSERT INTO vendors (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO vendors (title, year, runtime, genres, address_id, user_id)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6::bigint, 0))
 	RETURNING id, created_at, version;
 	`
-	args := []any{vendor.Title, vendor.Year, vendor.Runtime, pq.Array(vendor.Genres)}
+	args := []any{vendor.Title, vendor.Year, vendor.Runtime, pq.Array(vendor.Genres), vendor.AddressID, vendor.UserID}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -60,7 +70,7 @@ func (m VendorModel) Get(id int64) (*Vendor, error) {
 	}
 
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, COALESCE(address_id, ''), COALESCE(user_id, 0), version
 		FROM vendors
 		WHERE id = $1`
 
@@ -77,6 +87,8 @@ func (m VendorModel) Get(id int64) (*Vendor, error) {
 		&vendor.Year,
 		&vendor.Runtime,
 		pq.Array(&vendor.Genres),
+		&vendor.AddressID,
+		&vendor.UserID,
 		&vendor.Version,
 	)
 
@@ -91,11 +103,26 @@ func (m VendorModel) Get(id int64) (*Vendor, error) {
 	return &vendor, nil
 }
 
+// RunByAny reports whether one of the users runs a vendor.
+func (m VendorModel) RunByAny(userIDs ...int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var found bool
+
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM vendors WHERE user_id = ANY($1))`, pq.Array(userIDs)).Scan(&found)
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
 func (m VendorModel) Update(vendor *Vendor) error {
 	query := `
 		UPDATE vendors
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime = $3, genres = $4, address_id = NULLIF($5, ''), version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
 	args := []any{
@@ -103,6 +130,7 @@ func (m VendorModel) Update(vendor *Vendor) error {
 		vendor.Year,
 		vendor.Runtime,
 		pq.Array(vendor.Genres),
+		vendor.AddressID,
 		vendor.ID,
 		vendor.Version,
 	}
@@ -155,7 +183,7 @@ func (m VendorModel) Delete(id int64) error {
 func (m VendorModel) GetAll(title string, genres []string, filters Filters) ([]*Vendor, Metadata, error) {
 
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, COALESCE(address_id, ''), version
 	FROM vendors
 	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 	AND (genres @> $2 OR $2 = '{}')
@@ -191,6 +219,7 @@ func (m VendorModel) GetAll(title string, genres []string, filters Filters) ([]*
 			&vendor.Year,
 			&vendor.Runtime,
 			pq.Array(&vendor.Genres),
+			&vendor.AddressID,
 			&vendor.Version,
 		)
 		if err != nil {
@@ -208,3 +237,82 @@ func (m VendorModel) GetAll(title string, genres []string, filters Filters) ([]*
 
 	return vendors, metadata, nil
 }
+
+func (m VendorModel) GetAllInBound(minLat, minLng, maxLat, maxLng float64) ([]*VendorLocation, error) {
+	query := `
+	SELECT vendors.id, vendors.title, COALESCE(vendors.genres[1], ''), addresses.lat, addresses.lng
+	FROM vendors
+	INNER JOIN addresses ON addresses.id = vendors.address_id
+	WHERE addresses.lat BETWEEN $1 AND $3
+	AND addresses.lng BETWEEN $2 AND $4
+	ORDER BY vendors.id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, minLat, minLng, maxLat, maxLng)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []*VendorLocation{}
+
+	for rows.Next() {
+		var location VendorLocation
+
+		err := rows.Scan(
+			&location.ID,
+			&location.Name,
+			&location.Category,
+			&location.Lat,
+			&location.Lng,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, &location)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
+
+func (m VendorModel) GetLocation(id int64) (*VendorLocation, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT vendors.id, vendors.title, COALESCE(vendors.genres[1], ''), addresses.lat, addresses.lng
+	FROM vendors
+	INNER JOIN addresses ON addresses.id = vendors.address_id
+	WHERE vendors.id = $1`
+
+	var location VendorLocation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&location.ID,
+		&location.Name,
+		&location.Category,
+		&location.Lat,
+		&location.Lng,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &location, nil
+}
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var (
+	ErrRecordNotFound = errors.New("record not found")
+)
+
+// Job statuses. Completed jobs are deleted, so they have no status.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDead    = "dead"
+)
+
+// Job is a unit of background work stored in the jobs table.
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"-"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+type JobModel struct {
+	DB *sql.DB
+}
+
+// Insert stores a queued job and sets its ID, CreatedAt, Status and RunAt.
+func (m JobModel) Insert(job *Job) error {
+	query := `
+	INSERT INTO jobs (kind, payload, max_attempts)
+	VALUES ($1, $2, $3)
+	RETURNING id, created_at, status, run_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, job.Kind, job.Payload, job.MaxAttempts).Scan(&job.ID, &job.CreatedAt, &job.Status, &job.RunAt)
+}
+
+// Lease marks up to limit due jobs as running until the lease ends, counts
+// the attempt and returns them. Running jobs whose lease ran out, because
+// their instance died, are due again.
+func (m JobModel) Lease(limit int, lease time.Duration) ([]*Job, error) {
+	query := `
+	UPDATE jobs
+	SET status = 'running', attempts = attempts + 1, leased_until = NOW() + $2::bigint * interval '1 millisecond', updated_at = NOW()
+	WHERE id IN (
+		SELECT id
+		FROM jobs
+		WHERE (status = 'queued' AND run_at <= NOW())
+		OR (status = 'running' AND leased_until < NOW())
+		ORDER BY run_at ASC
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+
+	for rows.Next() {
+		var job Job
+
+		err := rows.Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.Kind,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// Complete deletes a job that ran successfully.
+func (m JobModel) Complete(id int64) error {
+	query := `
+	DELETE FROM jobs
+	WHERE id = $1`
+
+	return m.exec(query, id)
+}
+
+// Retry queues the job again at runAt, recording why the attempt failed.
+func (m JobModel) Retry(id int64, runAt time.Time, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET status = 'queued', run_at = $2, leased_until = NULL, last_error = $3, updated_at = NOW()
+	WHERE id = $1`
+
+	return m.exec(query, id, runAt, lastError)
+}
+
+// Release queues a leased job again without counting the attempt, for jobs
+// that were never started.
+func (m JobModel) Release(id int64) error {
+	query := `
+	UPDATE jobs
+	SET status = 'queued', attempts = attempts - 1, leased_until = NULL, updated_at = NOW()
+	WHERE id = $1`
+
+	return m.exec(query, id)
+}
+
+// Bury moves the job to the dead letters, where it stays until an operator
+// deletes or requeues it, or Purge deletes it.
+func (m JobModel) Bury(id int64, lastError string) error {
+	query := `
+	UPDATE jobs
+	SET status = 'dead', leased_until = NULL, last_error = $2, updated_at = NOW()
+	WHERE id = $1`
+
+	return m.exec(query, id, lastError)
+}
+
+// Purge deletes the dead jobs buried before the given time, and returns how
+// many there were.
+func (m JobModel) Purge(before time.Time) (int64, error) {
+	query := `
+	DELETE FROM jobs
+	WHERE status = 'dead' AND updated_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (m JobModel) exec(query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
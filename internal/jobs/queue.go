@@ -0,0 +1,319 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	gopool "github.com/pistolricks/go-api-template/internal/pool"
+)
+
+// maxBackoff caps the delay between two attempts of a job.
+const maxBackoff = time.Hour
+
+// purgeInterval is how often dead jobs past their retention are deleted.
+const purgeInterval = time.Hour
+
+// Handler runs a job from its raw payload. ctx is cancelled when the lease
+// ends or the queue is shut down.
+type Handler func(ctx context.Context, payload json.RawMessage) error
+
+// Config holds the queue settings.
+type Config struct {
+	// Concurrency is the number of jobs run at once by this instance.
+	Concurrency int
+	// PollInterval is how often the table is polled for due jobs.
+	PollInterval time.Duration
+	// Lease is how long a job may run before another instance may take it.
+	Lease time.Duration
+	// MaxAttempts is the number of attempts before a job is buried.
+	MaxAttempts int
+	// Backoff is the delay before the first retry; it doubles every attempt.
+	Backoff time.Duration
+	// Retention is how long dead jobs are kept for operators to look into
+	// before they are deleted. Zero keeps them forever.
+	Retention time.Duration
+}
+
+// Queue runs the jobs stored in the jobs table on the workers of a pool.
+type Queue struct {
+	model    JobModel
+	pool     *gopool.Pool
+	logger   *slog.Logger
+	cfg      Config
+	handlers map[string]Handler
+	periodic []*periodic
+
+	slots chan struct{}
+	wake  chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// New creates a queue. Handlers are registered with Handle or Register and
+// polling starts with Run.
+func New(db *sql.DB, pool *gopool.Pool, logger *slog.Logger, cfg Config) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Queue{
+		model:    JobModel{DB: db},
+		pool:     pool,
+		logger:   logger,
+		cfg:      cfg,
+		handlers: make(map[string]Handler),
+		slots:    make(chan struct{}, cfg.Concurrency),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Handle registers h for the jobs of the given kind. It must be called
+// before Run.
+func (q *Queue) Handle(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// periodic is a job enqueued at a fixed interval.
+type periodic struct {
+	kind     string
+	interval time.Duration
+	payload  any
+	next     time.Time
+}
+
+// Every enqueues a job of the given kind with payload when the queue starts
+// and then every interval. It must be called before Run. Every instance
+// enqueues its own, so the handler must not mind running on several
+// instances.
+func (q *Queue) Every(kind string, interval time.Duration, payload any) {
+	q.periodic = append(q.periodic, &periodic{kind: kind, interval: interval, payload: payload})
+}
+
+// Register registers fn for the jobs of the given kind, decoding their
+// payload into a fresh P.
+func Register[P any](q *Queue, kind string, fn func(ctx context.Context, p *P) error) {
+	q.Handle(kind, func(ctx context.Context, payload json.RawMessage) error {
+		p := new(P)
+		if err := json.Unmarshal(payload, p); err != nil {
+			return err
+		}
+		return fn(ctx, p)
+	})
+}
+
+// Enqueue stores a job of the given kind with payload encoded as JSON, and
+// wakes the queue up so it runs without waiting for the next poll.
+func (q *Queue) Enqueue(kind string, payload any) (*Job, error) {
+	if _, ok := q.handlers[kind]; !ok {
+		return nil, fmt.Errorf("jobs: no handler for %q", kind)
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		Kind:        kind,
+		Payload:     js,
+		MaxAttempts: q.cfg.MaxAttempts,
+	}
+
+	err = q.model.Insert(job)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// Run polls for due jobs until Shutdown is called.
+func (q *Queue) Run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	q.purge()
+
+	for {
+		q.schedule()
+		q.poll()
+
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		case <-purge.C:
+			q.purge()
+		}
+	}
+}
+
+// schedule enqueues the periodic jobs that are due.
+func (q *Queue) schedule() {
+	now := time.Now()
+
+	for _, p := range q.periodic {
+		if now.Before(p.next) {
+			continue
+		}
+
+		_, err := q.Enqueue(p.kind, p.payload)
+		if err != nil {
+			q.logger.Error(err.Error(), "kind", p.kind)
+			continue
+		}
+
+		p.next = now.Add(p.interval)
+	}
+}
+
+// purge deletes the dead jobs older than the retention.
+func (q *Queue) purge() {
+	if q.cfg.Retention <= 0 {
+		return
+	}
+
+	n, err := q.model.Purge(time.Now().Add(-q.cfg.Retention))
+	if err != nil {
+		q.logger.Error(err.Error())
+		return
+	}
+
+	if n > 0 {
+		q.logger.Info("dead jobs purged", "count", n)
+	}
+}
+
+// Shutdown stops polling and waits for the running jobs to complete, or for
+// ctx to be done, in which case the running jobs are cancelled and their
+// leases let another instance retry them.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.once.Do(func() {
+		close(q.stop)
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		<-q.done
+		q.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// poll leases as many due jobs as there are free slots and schedules them.
+func (q *Queue) poll() {
+	free := cap(q.slots) - len(q.slots)
+	if free == 0 {
+		return
+	}
+
+	jobs, err := q.model.Lease(free, q.cfg.Lease)
+	if err != nil {
+		q.logger.Error(err.Error())
+		return
+	}
+
+	for _, job := range jobs {
+		q.slots <- struct{}{}
+		q.wg.Add(1)
+
+		err := q.pool.Schedule(func() {
+			defer func() {
+				<-q.slots
+				q.wg.Done()
+			}()
+			q.run(job)
+		})
+		if err != nil {
+			<-q.slots
+			q.wg.Done()
+
+			if err := q.model.Release(job.ID); err != nil {
+				q.logger.Error(err.Error(), "job", job.ID)
+			}
+		}
+	}
+}
+
+// run calls the job's handler and records the outcome.
+func (q *Queue) run(job *Job) {
+	ctx, cancel := context.WithTimeout(q.ctx, q.cfg.Lease)
+	defer cancel()
+
+	err := q.call(ctx, job)
+
+	switch {
+	case err == nil:
+		err = q.model.Complete(job.ID)
+	case errors.Is(err, errUnknownKind) || job.Attempts >= job.MaxAttempts:
+		q.logger.Error("job failed for good", "job", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err.Error())
+		err = q.model.Bury(job.ID, err.Error())
+	default:
+		q.logger.Warn("job failed", "job", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err.Error())
+		err = q.model.Retry(job.ID, time.Now().Add(q.backoff(job.Attempts)), err.Error())
+	}
+	if err != nil {
+		q.logger.Error(err.Error(), "job", job.ID)
+	}
+}
+
+var errUnknownKind = errors.New("no handler for job kind")
+
+// call runs the handler, turning its panic into an error so the job is
+// retried like any failure.
+func (q *Queue) call(ctx context.Context, job *Job) (err error) {
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return errUnknownKind
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return h(ctx, job.Payload)
+}
+
+// backoff returns the delay before the attempt following the given one.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.cfg.Backoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, maxBackoff)
+}
@@ -0,0 +1,360 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidGrant is returned when the provider rejects the
+	// authorization code, e.g. because it expired or the verifier is wrong.
+	ErrInvalidGrant = errors.New("oauth: invalid authorization code")
+	// ErrNoSubject is returned when the provider's user info has no user ID.
+	ErrNoSubject = errors.New("oauth: user info has no subject")
+)
+
+// statusError is returned for responses other than 200 OK.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// Provider is an OAuth2 identity provider signed in to with the
+// authorization code flow and PKCE. OpenID Connect providers only need their
+// Issuer, their endpoints are discovered.
+type Provider struct {
+	Name         string   `json:"name"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Issuer       string   `json:"issuer"`
+	AuthURL      string   `json:"auth_url"`
+	TokenURL     string   `json:"token_url"`
+	UserInfoURL  string   `json:"userinfo_url"`
+	Scopes       []string `json:"scopes"`
+	// TrustEmail treats the email of the user info as verified when it has
+	// no email_verified claim, for providers that only share verified ones.
+	TrustEmail bool `json:"trust_email"`
+
+	Client *http.Client `json:"-"` // Client is the HTTP client used, defaults to http.DefaultClient.
+}
+
+// Presets are the providers known by name, whose endpoints need not be
+// configured.
+var Presets = map[string]Provider{
+	"facebook": {
+		AuthURL:     "https://www.facebook.com/v19.0/dialog/oauth",
+		TokenURL:    "https://graph.facebook.com/v19.0/oauth/access_token",
+		UserInfoURL: "https://graph.facebook.com/me?fields=id,name,email",
+		Scopes:      []string{"public_profile", "email"},
+		TrustEmail:  true,
+	},
+	"instagram": {
+		AuthURL:     "https://api.instagram.com/oauth/authorize",
+		TokenURL:    "https://api.instagram.com/oauth/access_token",
+		UserInfoURL: "https://graph.instagram.com/me?fields=id,username",
+		Scopes:      []string{"user_profile"},
+	},
+}
+
+// Identity is the user as described by the provider.
+type Identity struct {
+	Provider      string `json:"provider"`
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	// EmailClaimed is set when the provider stated that it verified the
+	// email, rather than being trusted to only share verified ones.
+	EmailClaimed bool `json:"-"`
+}
+
+// Load reads the providers from a JSON file holding an array of them, fills
+// in the presets and discovers the endpoints of OpenID Connect providers.
+func Load(ctx context.Context, path string) (map[string]*Provider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Provider
+
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: %s: %w", path, err)
+	}
+
+	providers := make(map[string]*Provider, len(list))
+
+	for _, p := range list {
+		if p.Name == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("oauth: %s: providers need a name, client_id and redirect_url", path)
+		}
+		if _, ok := providers[p.Name]; ok {
+			return nil, fmt.Errorf("oauth: %s: duplicate provider %q", path, p.Name)
+		}
+
+		if preset, ok := Presets[p.Name]; ok && p.Issuer == "" {
+			p.applyPreset(preset)
+		}
+
+		if p.Issuer != "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+			err := p.Discover(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+			return nil, fmt.Errorf("oauth: %s: provider %q needs an issuer or its endpoints", path, p.Name)
+		}
+
+		providers[p.Name] = p
+	}
+
+	return providers, nil
+}
+
+func (p *Provider) applyPreset(preset Provider) {
+	if p.AuthURL == "" {
+		p.AuthURL = preset.AuthURL
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = preset.TokenURL
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = preset.UserInfoURL
+	}
+	if p.Scopes == nil {
+		p.Scopes = preset.Scopes
+	}
+	p.TrustEmail = p.TrustEmail || preset.TrustEmail
+}
+
+// Discover reads the endpoints of the provider from its OpenID Connect
+// discovery document.
+func (p *Provider) Discover(ctx context.Context) error {
+	issuer := strings.TrimSuffix(p.Issuer, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+
+	err = p.do(req, &doc)
+	if err != nil {
+		return fmt.Errorf("oauth: discover %s: %w", p.Name, err)
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return fmt.Errorf("oauth: discover %s: issuer %q does not match %q", p.Name, doc.Issuer, p.Issuer)
+	}
+
+	if p.AuthURL == "" {
+		p.AuthURL = doc.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = doc.TokenEndpoint
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = doc.UserinfoEndpoint
+	}
+	if p.Scopes == nil {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return nil
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// Challenge returns the S256 PKCE code challenge of the verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the provider's consent page, which
+// redirects to the RedirectURL with the code and the state.
+func (p *Provider) AuthCodeURL(state, verifier string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"state":                 {state},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if len(p.Scopes) > 0 {
+		params.Set("scope", strings.Join(p.Scopes, " "))
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+
+	return p.AuthURL + sep + params.Encode()
+}
+
+// Exchange trades the authorization code for an access token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err = p.do(req, &token)
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && (statusErr.code == http.StatusBadRequest || statusErr.code == http.StatusUnauthorized) {
+			return "", fmt.Errorf("%w: %s: %s", ErrInvalidGrant, p.Name, err)
+		}
+		return "", fmt.Errorf("oauth: exchange %s: %w", p.Name, err)
+	}
+
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("oauth: exchange %s: no access token", p.Name)
+	}
+
+	return token.AccessToken, nil
+}
+
+// UserInfo returns the identity of the user the access token belongs to.
+// Both OpenID Connect claims and Graph API style fields are understood.
+func (p *Provider) UserInfo(ctx context.Context, accessToken string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var info map[string]any
+
+	err = p.do(req, &info)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: userinfo %s: %w", p.Name, err)
+	}
+
+	identity := &Identity{
+		Provider: p.Name,
+		Subject:  stringClaim(info, "sub"),
+		Email:    stringClaim(info, "email"),
+		Name:     stringClaim(info, "name"),
+	}
+
+	if identity.Subject == "" {
+		identity.Subject = stringClaim(info, "id")
+	}
+	if identity.Subject == "" {
+		return nil, ErrNoSubject
+	}
+
+	if identity.Name == "" {
+		identity.Name = stringClaim(info, "username")
+	}
+
+	if _, ok := info["email_verified"]; ok {
+		identity.EmailVerified, _ = strconv.ParseBool(stringClaim(info, "email_verified"))
+		identity.EmailClaimed = identity.EmailVerified
+	} else {
+		identity.EmailVerified = p.TrustEmail
+	}
+	identity.EmailVerified = identity.EmailVerified && identity.Email != ""
+	identity.EmailClaimed = identity.EmailClaimed && identity.Email != ""
+
+	return identity, nil
+}
+
+func (p *Provider) do(req *http.Request, dst any) error {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("unexpected status code: %s: %s", resp.Status, bytes.TrimSpace(body)),
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	return dec.Decode(dst)
+}
+
+// stringClaim returns a string, number or boolean claim as a string.
+func stringClaim(info map[string]any, key string) string {
+	switch v := info[key].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
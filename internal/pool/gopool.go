@@ -1,18 +1,67 @@
 package gopool
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// ErrScheduleTimeout returned by Pool to indicate that there no free
-// goroutines during some period of time.
-var ErrScheduleTimeout = fmt.Errorf("schedule error: timed out")
+var (
+	// ErrScheduleTimeout returned by Pool to indicate that there no free
+	// goroutines during some period of time.
+	ErrScheduleTimeout = fmt.Errorf("schedule error: timed out")
+
+	// ErrPoolClosed returned by Pool when a task is scheduled after Close or
+	// Shutdown was called.
+	ErrPoolClosed = errors.New("schedule error: pool closed")
+)
+
+// PanicError holds the value recovered from a panicking task and the stack
+// of the goroutine that ran it.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v", e.Value)
+}
+
+// Stats is a snapshot of the pool counters.
+type Stats struct {
+	Workers  int64 `json:"workers"`
+	Queued   int64 `json:"queued"`
+	Timeouts int64 `json:"timeouts"`
+	Panics   int64 `json:"panics"`
+}
 
 // Pool contains logic of goroutine reuse.
 type Pool struct {
 	sem  chan struct{}
 	work chan func()
+
+	// OnPanic, when set, is called with the panic recovered from a task. The
+	// worker keeps running. It must be set before tasks are scheduled.
+	OnPanic func(err *PanicError)
+
+	// mu is held for reading while scheduling, so that once Close holds it
+	// for writing no task can enter the queue anymore.
+	mu     sync.RWMutex
+	closed bool
+
+	once sync.Once
+	done chan struct{} // closed when closing starts; unblocks schedulers
+	stop chan struct{} // closed once no task can be scheduled; workers drain and exit
+	wg   sync.WaitGroup
+
+	workers  atomic.Int64
+	queued   atomic.Int64
+	timeouts atomic.Int64
+	panics   atomic.Int64
 }
 
 // NewPool creates new goroutine pool with given size. It also creates a work
@@ -28,47 +77,155 @@ func NewPool(size, queue, spawn int) *Pool {
 	p := &Pool{
 		sem:  make(chan struct{}, size),
 		work: make(chan func(), queue),
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
 	}
 	for i := 0; i < spawn; i++ {
 		p.sem <- struct{}{}
-		go p.worker(func() {})
+		p.spawn(func() {})
 	}
 
 	return p
 }
 
-// Schedule schedules task to be executed over pool's workers.
-func (p *Pool) Schedule(task func()) {
-	err := p.schedule(task, nil)
-	if err != nil {
-		return
-	}
+// Schedule schedules task to be executed over pool's workers. It blocks until
+// a worker or a queue slot is free, and returns ErrPoolClosed once the pool
+// is closed.
+func (p *Pool) Schedule(task func()) error {
+	return p.schedule(task, nil, nil)
 }
 
 // ScheduleTimeout schedules task to be executed over pool's workers.
 // It returns ErrScheduleTimeout when no free workers met during given timeout.
 func (p *Pool) ScheduleTimeout(timeout time.Duration, task func()) error {
-	return p.schedule(task, time.After(timeout))
+	return p.schedule(task, time.After(timeout), nil)
+}
+
+// ScheduleContext schedules task to be executed over pool's workers. It
+// returns the context's error when ctx is done before a free worker is met.
+func (p *Pool) ScheduleContext(ctx context.Context, task func()) error {
+	return p.schedule(task, nil, ctx)
+}
+
+// Stats returns the current pool counters.
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Workers:  p.workers.Load(),
+		Queued:   p.queued.Load(),
+		Timeouts: p.timeouts.Load(),
+		Panics:   p.panics.Load(),
+	}
 }
 
-func (p *Pool) schedule(task func(), timeout <-chan time.Time) error {
+// Close stops accepting tasks and waits for the queued ones to complete.
+func (p *Pool) Close() error {
+	return p.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting tasks and waits for the queued ones to complete,
+// or for ctx to be done, in which case the context's error is returned and
+// workers finish the queue in the background.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.once.Do(func() {
+		close(p.done)
+
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+
+		close(p.stop)
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) schedule(task func(), timeout <-chan time.Time, ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	var cancel <-chan struct{}
+	if ctx != nil {
+		cancel = ctx.Done()
+	}
+
 	select {
+	case <-p.done:
+		return ErrPoolClosed
 	case <-timeout:
+		p.timeouts.Add(1)
 		return ErrScheduleTimeout
+	case <-cancel:
+		p.timeouts.Add(1)
+		return ctx.Err()
 	case p.work <- task:
+		p.queued.Add(1)
 		return nil
 	case p.sem <- struct{}{}:
-		go p.worker(task)
+		p.spawn(task)
 		return nil
 	}
 }
 
+func (p *Pool) spawn(task func()) {
+	p.wg.Add(1)
+	p.workers.Add(1)
+	go p.worker(task)
+}
+
 func (p *Pool) worker(task func()) {
-	defer func() { <-p.sem }()
+	defer func() {
+		p.workers.Add(-1)
+		<-p.sem
+		p.wg.Done()
+	}()
 
-	task()
+	p.run(task)
 
-	for task := range p.work {
-		task()
+	for {
+		select {
+		case task := <-p.work:
+			p.queued.Add(-1)
+			p.run(task)
+		case <-p.stop:
+			for {
+				select {
+				case task := <-p.work:
+					p.queued.Add(-1)
+					p.run(task)
+				default:
+					return
+				}
+			}
+		}
 	}
 }
+
+// run calls task, recovering and reporting its panic so that the worker
+// survives it.
+func (p *Pool) run(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.panics.Add(1)
+			if p.OnPanic != nil {
+				p.OnPanic(&PanicError{Value: r, Stack: debug.Stack()})
+			}
+		}
+	}()
+
+	task()
+}
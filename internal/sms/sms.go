@@ -0,0 +1,51 @@
+package sms
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sender delivers text messages to phone numbers.
+type Sender interface {
+	Send(phone, message string) error
+}
+
+// LogSender writes the messages to a logger instead of sending them, for
+// development.
+type LogSender struct {
+	Logger *slog.Logger
+}
+
+func (s LogSender) Send(phone, message string) error {
+	s.Logger.Info("sms", "phone", phone, "message", message)
+	return nil
+}
+
+// FileSender appends the messages to a file instead of sending them, so
+// tests can read the codes back.
+type FileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileSender) Send(phone, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), phone, message)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -1,29 +1,67 @@
 package ws
 
 import (
+	"compress/flate"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 	_ "github.com/pistolricks/go-api-template/internal/pool"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
+// maxMessageSize is the largest message, in bytes once inflated, read from a
+// connection. It leaves room around MaxTextLength for the JSON-RPC envelope.
+const maxMessageSize = 64 << 10
+
+// ErrMessageTooBig is returned when a connection sends a message larger than
+// maxMessageSize.
+var ErrMessageTooBig = errors.New("ws: message too big")
+
 type Agent struct {
 	io      sync.Mutex
 	conn    io.ReadWriteCloser
 	id      int64
+	userID  int64
 	name    string
 	message *Message
+	rooms   map[string]struct{} // guarded by message.mu
+	away    bool                // guarded by message.mu
+
+	permissions []string
+	codec       Codec
+	compress    bool
+	stream      bool
+
+	qmu      sync.Mutex
+	queue    []outbound // guarded by qmu
+	flushing bool       // guarded by qmu
+	onClose  func()     // guarded by qmu
+	closed   atomic.Bool
+	lastSeen atomic.Int64
+}
+
+// UserID returns the id of the user the agent is authenticated as.
+func (a *Agent) UserID() int64 {
+	return a.userID
+}
+
+// Name returns the agent's current display name.
+func (a *Agent) Name() string {
+	return a.name
 }
 
 type AgentModel struct {
 	DB *sql.DB
 }
 
+// Receive reads a single frame from the connection and answers the
+// JSON-RPC request or batch it holds.
 func (a *Agent) Receive() error {
-	req, err := a.readRequest()
+	p, err := a.readFrame()
 	if err != nil {
 		err := a.conn.Close()
 		if err != nil {
@@ -31,104 +69,96 @@ func (a *Agent) Receive() error {
 		}
 		return err
 	}
-	if req == nil {
+	if p == nil {
 		// Handled some control message.
 		return nil
 	}
-	switch req.Method {
-	case "rename":
-		name, ok := req.Params["name"].(string)
-		if !ok {
-			return a.writeErrorTo(req, Object{
-				"error": "bad params",
-			})
-		}
-		prev, ok := a.message.Rename(a, name)
-		if !ok {
-			return a.writeErrorTo(req, Object{
-				"error": "already exists",
-			})
-		}
-		err := a.message.Broadcast("rename", Object{
-			"prev": prev,
-			"name": name,
-			"time": timestamp(),
-		})
-		if err != nil {
-			return err
-		}
-		return a.writeResultTo(req, nil)
-	case "publish":
-		req.Params["author"] = a.name
-		req.Params["time"] = timestamp()
-		err := a.message.Broadcast("publish", req.Params)
-		if err != nil {
-			return err
-		}
-	default:
-		return a.writeErrorTo(req, Object{
-			"error": "not implemented",
-		})
+
+	res := a.handle(p)
+	if res == nil {
+		return nil
 	}
-	return nil
+
+	return a.write(res)
 }
 
-// readRequests reads json-rpc request from connection.
+// readFrame reads the next data message from connection and returns it as
+// JSON. It returns nil after handling a control frame.
 // It takes io mutex.
-func (a *Agent) readRequest() (*Request, error) {
+func (a *Agent) readFrame() ([]byte, error) {
 	a.io.Lock()
 	defer a.io.Unlock()
 
-	h, r, err := wsutil.NextReader(a.conn, ws.StateServerSide)
+	var msg wsflate.MessageState
+	rd := wsutil.Reader{
+		Source:         a.conn,
+		State:          ws.StateServerSide,
+		OnIntermediate: wsutil.ControlFrameHandler(a.conn, ws.StateServerSide),
+	}
+	if a.compress {
+		rd.State |= ws.StateExtended
+		rd.Extensions = []wsutil.RecvExtension{&msg}
+	}
+
+	h, err := rd.NextFrame()
 	if err != nil {
 		return nil, err
 	}
+	a.touch()
 	if h.OpCode.IsControl() {
-		return nil, wsutil.ControlFrameHandler(a.conn, ws.StateServerSide)(h, r)
+		return nil, wsutil.ControlFrameHandler(a.conn, ws.StateServerSide)(h, &rd)
+	}
+
+	var r io.Reader = &rd
+	if msg.IsCompressed() {
+		r = wsflate.NewReader(r, func(r io.Reader) wsflate.Decompressor {
+			return flate.NewReader(r)
+		})
 	}
 
-	req := &Request{}
-	decoder := json.NewDecoder(r)
-	if err := decoder.Decode(req); err != nil {
+	// A small compressed frame may inflate to gigabytes, so stop reading
+	// past the limit.
+	p, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
 		return nil, err
 	}
+	if len(p) > maxMessageSize {
+		frame := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusMessageTooBig, ""))
+		if err := ws.WriteFrame(a.conn, frame); err != nil {
+			return nil, err
+		}
+		return nil, ErrMessageTooBig
+	}
 
-	return req, nil
+	return a.codec.Decode(p)
 }
 
-func (a *Agent) writeErrorTo(req *Request, err Object) error {
-	return a.write(Error{
-		ID:    req.ID,
-		Error: err,
-	})
-}
+func (a *Agent) writeNotice(method string, params Object) error {
+	msg := Notification{
+		JSONRPC: Version,
+		Method:  method,
+		Params:  params,
+	}
 
-func (a *Agent) writeResultTo(req *Request, result Object) error {
-	return a.write(Response{
-		ID:     req.ID,
-		Result: result,
-	})
-}
+	if a.stream {
+		bts, err := sseEvent(0, msg)
+		if err != nil {
+			return err
+		}
+		return a.writeRaw(bts)
+	}
 
-func (a *Agent) writeNotice(method string, params Object) error {
-	return a.write(Request{
-		Method: method,
-		Params: params,
-	})
+	return a.write(msg)
 }
 
+// write encodes x with the agent's codec and writes it as a single frame.
 func (a *Agent) write(x interface{}) error {
-	w := wsutil.NewWriter(a.conn, ws.StateServerSide, ws.OpText)
-	encoder := json.NewEncoder(w)
-
-	a.io.Lock()
-	defer a.io.Unlock()
-
-	if err := encoder.Encode(x); err != nil {
+	bts, err := frame(a.codec, a.compress, x)
+	if err != nil {
 		return err
 	}
 
-	return w.Flush()
+	return a.writeRaw(bts)
 }
 
 func (a *Agent) writeRaw(p []byte) error {
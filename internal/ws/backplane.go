@@ -0,0 +1,186 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrPayloadTooLarge is returned by PostgresBackplane when an envelope does
+// not fit into a NOTIFY payload.
+var ErrPayloadTooLarge = errors.New("backplane: payload too large")
+
+// Envelope is a notice travelling through the Backplane. It is delivered to
+// the agents that joined Room, to the agents of Users, or to every agent when
+// both are empty. Envelopes carrying Presence or Snapshot update the shared
+// presence state instead. ID is set once the envelope is stored as an event.
+type Envelope struct {
+	ID       int64     `json:"id,omitempty"`
+	Origin   string    `json:"origin"`
+	Room     string    `json:"room,omitempty"`
+	Users    []int64   `json:"users,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Params   Object    `json:"params,omitempty"`
+	Presence *Presence `json:"presence,omitempty"`
+	// Gen is the snapshot generation of Origin when Presence was announced.
+	Gen int64 `json:"gen,omitempty"`
+	// Snapshot carries the presence of every user connected to Origin.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	// Sync asks every instance to publish a snapshot. A backplane that may
+	// have missed envelopes delivers one without Origin to its own hub.
+	Sync bool `json:"sync,omitempty"`
+
+	// From is the user who wrote the notice, if any. Agents of users who
+	// blocked them do not receive it.
+	From int64 `json:"from,omitempty"`
+	// Block carries a change to a user's blocked senders.
+	Block *Block `json:"block,omitempty"`
+	// Disconnect closes the connections of Users once the notice is written.
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// Backplane fans envelopes out to every hub instance, including the one that
+// published them.
+type Backplane interface {
+	Publish(env *Envelope) error
+	Envelopes() <-chan *Envelope
+	Close() error
+}
+
+// MemoryBackplane is a Backplane for a single instance.
+type MemoryBackplane struct {
+	once sync.Once
+	out  chan *Envelope
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		out: make(chan *Envelope, 1),
+	}
+}
+
+func (b *MemoryBackplane) Publish(env *Envelope) error {
+	b.out <- env
+	return nil
+}
+
+func (b *MemoryBackplane) Envelopes() <-chan *Envelope {
+	return b.out
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.once.Do(func() { close(b.out) })
+	return nil
+}
+
+// PostgresBackplane is a Backplane shared by every instance connected to the
+// same database, built on LISTEN/NOTIFY.
+type PostgresBackplane struct {
+	db       *sql.DB
+	channel  string
+	listener *pq.Listener
+	out      chan *Envelope
+	done     chan struct{}
+	once     sync.Once
+}
+
+// maxNotifyPayload is the largest payload NOTIFY accepts by default.
+const maxNotifyPayload = 8000
+
+// NewPostgresBackplane listens on channel using a dedicated connection opened
+// with dsn and publishes through db.
+func NewPostgresBackplane(db *sql.DB, dsn string, channel string) (*PostgresBackplane, error) {
+	listener := pq.NewListener(dsn, 10*time.Millisecond, time.Minute, nil)
+
+	err := listener.Listen(channel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBackplane{
+		db:       db,
+		channel:  channel,
+		listener: listener,
+		out:      make(chan *Envelope, 64),
+		done:     make(chan struct{}),
+	}
+
+	go b.reader()
+
+	return b, nil
+}
+
+func (b *PostgresBackplane) Publish(env *Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if len(payload) >= maxNotifyPayload {
+		return ErrPayloadTooLarge
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = b.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, b.channel, string(payload))
+	return err
+}
+
+func (b *PostgresBackplane) Envelopes() <-chan *Envelope {
+	return b.out
+}
+
+func (b *PostgresBackplane) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+	})
+	return err
+}
+
+// reader decodes notifications into envelopes until the backplane is closed.
+func (b *PostgresBackplane) reader() {
+	defer close(b.out)
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			env := &Envelope{}
+			if n == nil {
+				// The connection was re-established; notifications sent in
+				// the meantime are lost, so have the hub resync.
+				env.Sync = true
+			} else if err := json.Unmarshal([]byte(n.Extra), env); err != nil {
+				continue
+			}
+			select {
+			case b.out <- env:
+			case <-b.done:
+				return
+			}
+		}
+	}
+}
+
+// newInstanceID returns a random id identifying this hub on the backplane.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
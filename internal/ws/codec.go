@@ -0,0 +1,216 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols selecting the encoding of a connection during upgrade. A
+// connection offering neither speaks JSON.
+const (
+	ProtocolJSON    = "jsonrpc"
+	ProtocolMsgpack = "jsonrpc.msgpack"
+)
+
+// Codec encodes the JSON-RPC messages of a connection.
+type Codec interface {
+	// OpCode is the frame type carrying encoded messages.
+	OpCode() ws.OpCode
+	// Encode encodes v into a frame payload.
+	Encode(v any) ([]byte, error)
+	// Decode converts a frame payload into JSON.
+	Decode(p []byte) ([]byte, error)
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+)
+
+// CodecFor returns the codec selected by the negotiated subprotocol.
+func CodecFor(protocol string) Codec {
+	if protocol == ProtocolMsgpack {
+		return Msgpack
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) OpCode() ws.OpCode {
+	return ws.OpText
+}
+
+func (jsonCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+// msgpackCodec maps messages through their JSON form, so MessagePack clients
+// see the same field names and values as JSON clients.
+type msgpackCodec struct{}
+
+func (msgpackCodec) OpCode() ws.OpCode {
+	return ws.OpBinary
+}
+
+func (msgpackCodec) Encode(v any) ([]byte, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(numbers(generic))
+}
+
+func (msgpackCodec) Decode(p []byte) ([]byte, error) {
+	var generic any
+	if err := msgpack.Unmarshal(p, &generic); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(generic)
+}
+
+// numbers replaces the json.Numbers in v with integers where possible and
+// floats otherwise.
+func numbers(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(x.String(), 10, 64); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]any:
+		for k, e := range x {
+			x[k] = numbers(e)
+		}
+	case []any:
+		for i, e := range x {
+			x[i] = numbers(e)
+		}
+	}
+	return v
+}
+
+// frame encodes v with codec into a ready to send frame, compressed with
+// permessage-deflate when compress is set.
+func frame(codec Codec, compress bool, v any) ([]byte, error) {
+	p, err := codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	f := ws.NewFrame(codec.OpCode(), true, p)
+	if compress {
+		f.Payload, err = deflate(p)
+		if err != nil {
+			return nil, err
+		}
+		f.Header, err = wsflate.SetBit(f.Header)
+		if err != nil {
+			return nil, err
+		}
+		f.Header.Length = int64(len(f.Payload))
+	}
+
+	return ws.CompileFrame(f)
+}
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		fw, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return fw
+	},
+}
+
+// deflateTail is the empty block ending every flushed deflate stream, which
+// permessage-deflate leaves out of the payload.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflate compresses p into a permessage-deflate payload without context
+// takeover.
+func deflate(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fw := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(fw)
+	fw.Reset(&buf)
+
+	if _, err := fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// notice is a server notification encoded at most once per codec and
+// compression setting.
+type notice struct {
+	id     int64
+	msg    Notification
+	frames map[frameKey][]byte
+}
+
+type frameKey struct {
+	codec    Codec
+	compress bool
+	stream   bool
+}
+
+// newNotice returns a notice for the event with the given id, or for an
+// event that was not stored when id is zero.
+func newNotice(id int64, method string, params Object) *notice {
+	return &notice{
+		id:     id,
+		msg:    Notification{JSONRPC: Version, Method: method, Params: params},
+		frames: make(map[frameKey][]byte, 1),
+	}
+}
+
+// frame returns the notice encoded for agent. It is not safe for concurrent
+// use.
+func (n *notice) frame(agent *Agent) ([]byte, error) {
+	key := frameKey{agent.codec, agent.compress, agent.stream}
+	if bts, ok := n.frames[key]; ok {
+		return bts, nil
+	}
+
+	var (
+		bts []byte
+		err error
+	)
+	if agent.stream {
+		bts, err = sseEvent(n.id, n.msg)
+	} else {
+		bts, err = frame(agent.codec, agent.compress, n.msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.frames[key] = bts
+
+	return bts, nil
+}
@@ -0,0 +1,190 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Conversation is a direct, one-to-one conversation between two users.
+type Conversation struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserIDs   []int64   `json:"user_ids"`
+}
+
+// Includes reports whether the user takes part in the conversation.
+func (c *Conversation) Includes(userID int64) bool {
+	return slices.Contains(c.UserIDs, userID)
+}
+
+type ConversationModel struct {
+	DB *sql.DB
+}
+
+// GetOrCreate returns the conversation between the two users, creating it if
+// it does not exist yet.
+func (m ConversationModel) GetOrCreate(userID, otherID int64) (*Conversation, error) {
+	if userID < 1 || otherID < 1 || userID == otherID {
+		return nil, ErrRecordNotFound
+	}
+
+	user1, user2 := min(userID, otherID), max(userID, otherID)
+
+	query := `
+	INSERT INTO conversations (user1_id, user2_id)
+	VALUES ($1, $2)
+	ON CONFLICT (user1_id, user2_id) DO UPDATE SET user1_id = EXCLUDED.user1_id
+	RETURNING id, created_at, updated_at`
+
+	conversation := Conversation{UserIDs: []int64{user1, user2}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user1, user2).Scan(&conversation.ID, &conversation.CreatedAt, &conversation.UpdatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: insert or update on table "conversations" violates foreign key constraint "conversations_user1_id_fkey"`,
+			err.Error() == `pq: insert or update on table "conversations" violates foreign key constraint "conversations_user2_id_fkey"`:
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &conversation, nil
+}
+
+// GetBetween returns the conversation between the two users.
+func (m ConversationModel) GetBetween(userID, otherID int64) (*Conversation, error) {
+	user1, user2 := min(userID, otherID), max(userID, otherID)
+
+	query := `
+	SELECT id, created_at, updated_at
+	FROM conversations
+	WHERE user1_id = $1 AND user2_id = $2`
+
+	conversation := Conversation{UserIDs: []int64{user1, user2}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, user1, user2).Scan(&conversation.ID, &conversation.CreatedAt, &conversation.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &conversation, nil
+}
+
+func (m ConversationModel) Get(id int64) (*Conversation, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, updated_at, user1_id, user2_id
+	FROM conversations
+	WHERE id = $1`
+
+	var (
+		conversation     Conversation
+		user1ID, user2ID int64
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&conversation.ID,
+		&conversation.CreatedAt,
+		&conversation.UpdatedAt,
+		&user1ID,
+		&user2ID,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	conversation.UserIDs = []int64{user1ID, user2ID}
+
+	return &conversation, nil
+}
+
+// Touch marks the conversation as updated, moving it to the top of its
+// participants' conversation lists.
+func (m ConversationModel) Touch(id int64) error {
+	query := `
+	UPDATE conversations
+	SET updated_at = NOW()
+	WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// GetAllForUser returns the user's conversations, most recently active first.
+func (m ConversationModel) GetAllForUser(userID int64, limit, offset int) ([]*Conversation, error) {
+	query := `
+	SELECT id, created_at, updated_at, user1_id, user2_id
+	FROM conversations
+	WHERE user1_id = $1 OR user2_id = $1
+	ORDER BY updated_at DESC, id DESC
+	LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []*Conversation{}
+
+	for rows.Next() {
+		var (
+			conversation     Conversation
+			user1ID, user2ID int64
+		)
+
+		err := rows.Scan(
+			&conversation.ID,
+			&conversation.CreatedAt,
+			&conversation.UpdatedAt,
+			&user1ID,
+			&user2ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		conversation.UserIDs = []int64{user1ID, user2ID}
+		conversations = append(conversations, &conversation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
@@ -0,0 +1,107 @@
+package ws
+
+import "errors"
+
+// Send stores params as a direct message from agent and delivers it to every
+// connected agent of both participants. The conversation is either the one
+// with the given id, which agent's user must take part in, or the one between
+// agent's user and the user with id to, created on first use if the policy
+// lets them talk.
+func (m *Message) Send(agent *Agent, conversationID, to int64, params Object) (*Record, error) {
+	var (
+		conversation *Conversation
+		err          error
+	)
+
+	if conversationID > 0 {
+		conversation, err = m.models.Conversations.Get(conversationID)
+		if err == nil && !conversation.Includes(agent.userID) {
+			err = ErrRecordNotFound
+		}
+	} else {
+		conversation, err = m.models.Conversations.GetBetween(agent.userID, to)
+		if errors.Is(err, ErrRecordNotFound) {
+			err = m.canContact(agent.userID, to)
+			if err == nil {
+				conversation, err = m.models.Conversations.GetOrCreate(agent.userID, to)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range conversation.UserIDs {
+		if id == agent.userID {
+			continue
+		}
+		blocked, err := m.models.Blocks.Exists(id, agent.userID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, ErrBlocked
+		}
+	}
+
+	err = m.filter(params)
+	if err != nil {
+		return nil, err
+	}
+
+	params["author"] = agent.name
+	params["user_id"] = agent.userID
+	params["conversation_id"] = conversation.ID
+	params["time"] = timestamp()
+
+	record := &Record{
+		Author:         agent.name,
+		UserID:         agent.userID,
+		ConversationID: conversation.ID,
+		Params:         params,
+	}
+
+	err = m.models.Messages.Insert(record)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.models.Conversations.Touch(conversation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	params["id"] = record.ID
+
+	return record, m.publish(&Envelope{
+		Origin: m.instance,
+		Users:  conversation.UserIDs,
+		From:   agent.userID,
+		Method: "message",
+		Params: params,
+	})
+}
+
+// ConversationHistory returns up to limit stored messages of the conversation
+// sent after cursor. agent's user must take part in the conversation.
+func (m *Message) ConversationHistory(agent *Agent, conversationID, cursor int64, limit int) ([]*Record, error) {
+	conversation, err := m.models.Conversations.Get(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !conversation.Includes(agent.userID) {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.models.Messages.GetAfter("", conversation.ID, cursor, historyLimit(limit))
+}
+
+// SendTo sends a notice to all connected agents of the given users.
+func (m *Message) SendTo(userIDs []int64, method string, params Object) error {
+	return m.publish(&Envelope{
+		Origin: m.instance,
+		Users:  userIDs,
+		Method: method,
+		Params: params,
+	})
+}
@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// MaxReplay caps the number of events replayed to a resuming stream.
+	MaxReplay = 500
+
+	// replayWindow is how far back a resuming stream may go.
+	replayWindow = 24 * time.Hour
+)
+
+// ephemeral lists the notices that are not worth replaying to a stream that
+// reconnects.
+var ephemeral = map[string]bool{
+	"greet":   true,
+	"goodbye": true,
+	"typing":  true,
+	"join":    true,
+	"leave":   true,
+}
+
+// EventModel stores the notices published through the hub so streams can
+// resume from the last event they received.
+type EventModel struct {
+	DB *sql.DB
+}
+
+// Insert stores env and sets its ID.
+func (m EventModel) Insert(env *Envelope) error {
+	params, err := json.Marshal(env.Params)
+	if err != nil {
+		return err
+	}
+
+	var users any
+	if env.Users != nil {
+		users = pq.Array(env.Users)
+	}
+
+	query := `
+	INSERT INTO events (room, user_ids, method, params)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, env.Room, users, env.Method, params).Scan(&env.ID)
+}
+
+// GetAfter returns the events with an id greater than cursor that were sent
+// to everyone, to userID or to one of rooms, oldest first.
+func (m EventModel) GetAfter(userID int64, rooms []string, cursor int64) ([]*Envelope, error) {
+	query := `
+	SELECT id, room, user_ids, method, params
+	FROM events
+	WHERE id > $1
+	AND created_at > $2
+	AND ((room = '' AND user_ids IS NULL) OR $3 = ANY(user_ids) OR room = ANY($4))
+	ORDER BY id ASC
+	LIMIT $5`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, cursor, time.Now().Add(-replayWindow), userID, pq.Array(rooms), MaxReplay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	envs := []*Envelope{}
+
+	for rows.Next() {
+		var (
+			env    Envelope
+			params []byte
+		)
+
+		err := rows.Scan(&env.ID, &env.Room, pq.Array(&env.Users), &env.Method, &params)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(params, &env.Params); err != nil {
+			return nil, err
+		}
+
+		envs = append(envs, &env)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return envs, nil
+}
+
+// Prune deletes the events too old to be replayed, and returns how many
+// there were.
+func (m EventModel) Prune() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM events WHERE created_at < $1`, time.Now().Add(-replayWindow))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,69 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ErrFiltered is wrapped by the errors of filters rejecting a text.
+var ErrFiltered = errors.New("rejected by content filter")
+
+// Filter checks the text of messages and names before they are published.
+type Filter interface {
+	// Check returns an error wrapping ErrFiltered when text must not be
+	// published.
+	Check(text string) error
+}
+
+// Filters applies every filter in turn.
+type Filters []Filter
+
+func (fs Filters) Check(text string) error {
+	for _, f := range fs {
+		if err := f.Check(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WordList rejects texts containing one of its words, ignoring case.
+type WordList map[string]struct{}
+
+func NewWordList(words []string) WordList {
+	wl := make(WordList, len(words))
+	for _, w := range words {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			wl[w] = struct{}{}
+		}
+	}
+	return wl
+}
+
+func (wl WordList) Check(text string) error {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	for _, w := range words {
+		if _, ok := wl[w]; ok {
+			return fmt.Errorf("%w: contains a blocked word", ErrFiltered)
+		}
+	}
+	return nil
+}
+
+var rxLink = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|co|info|biz|xyz|ru|me|ly|gg)\b`)
+
+// LinkBlocker rejects texts containing links.
+type LinkBlocker struct{}
+
+func (LinkBlocker) Check(text string) error {
+	if rxLink.MatchString(text) {
+		return fmt.Errorf("%w: links are not allowed", ErrFiltered)
+	}
+	return nil
+}
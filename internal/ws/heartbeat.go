@@ -0,0 +1,231 @@
+package ws
+
+import (
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// SlowDrop discards notices for agents whose outbound queue is full.
+	SlowDrop = "drop"
+	// SlowDisconnect evicts agents whose outbound queue is full.
+	SlowDisconnect = "disconnect"
+)
+
+// Config tunes the hub's heartbeat and slow-consumer handling.
+type Config struct {
+	// PingInterval is how often agents are sent a ping frame. Zero disables
+	// the heartbeat.
+	PingInterval time.Duration
+	// PongTimeout is how long an agent may stay silent, pongs included,
+	// before it is evicted.
+	PongTimeout time.Duration
+	// SendQueue is the number of notices buffered for each agent.
+	SendQueue int
+	// SlowPolicy is SlowDrop or SlowDisconnect.
+	SlowPolicy string
+	// RateLimit is the number of messages per second a user may send, with
+	// bursts of up to RateBurst. Zero disables the limit.
+	RateLimit float64
+	RateBurst int
+	// Filter checks messages and names before they are published. Nil
+	// accepts everything.
+	Filter Filter
+	// Policy decides who users may talk to. Nil lets no one start a
+	// conversation or join a room.
+	Policy Policy
+	// PresenceInterval is how often the hub announces the presence of its
+	// users to the other instances, 30s by default. Instances not heard from
+	// within PresenceTTL, three intervals by default, are considered gone
+	// and their users offline.
+	PresenceInterval time.Duration
+	PresenceTTL      time.Duration
+}
+
+// Stats is a snapshot of the hub's counters.
+type Stats struct {
+	Agents     int   `json:"agents"`
+	QueueDepth int64 `json:"queue_depth"`
+	Dropped    int64 `json:"dropped"`
+	Evictions  int64 `json:"evictions"`
+}
+
+// Stats returns the current hub counters.
+func (m *Message) Stats() Stats {
+	m.mu.RLock()
+	agents := len(m.agent)
+	m.mu.RUnlock()
+
+	return Stats{
+		Agents:     agents,
+		QueueDepth: m.queued.Load(),
+		Dropped:    m.dropped.Load(),
+		Evictions:  m.evictions.Load(),
+	}
+}
+
+// Evict closes the agent's connection and removes it from the hub.
+func (m *Message) Evict(agent *Agent) {
+	if !agent.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.evictions.Add(1)
+
+	agent.conn.Close()
+
+	agent.qmu.Lock()
+	onClose := agent.onClose
+	agent.qmu.Unlock()
+
+	if onClose != nil {
+		onClose()
+	}
+
+	m.Remove(agent)
+}
+
+// heartbeat pings every agent each PingInterval and evicts the ones that
+// have not been heard from within PongTimeout.
+func (m *Message) heartbeat() {
+	ticker := time.NewTicker(m.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.mu.RLock()
+			us := make([]*Agent, len(m.agent))
+			copy(us, m.agent)
+			m.mu.RUnlock()
+
+			deadline := now.Add(-m.cfg.PongTimeout).UnixNano()
+			for _, u := range us {
+				if u.stream {
+					// Streams cannot answer; a failed write evicts them.
+					u.enqueue(0, sseKeepAlive)
+					continue
+				}
+				if u.lastSeen.Load() < deadline {
+					m.Evict(u)
+					continue
+				}
+				u.enqueue(0, ws.CompiledPing)
+			}
+		}
+	}
+}
+
+// outbound is an encoded frame waiting in an agent's queue, with the id of
+// the event it carries, if any.
+type outbound struct {
+	id  int64
+	bts []byte
+}
+
+// enqueue buffers an encoded frame for the agent and makes sure a pool
+// goroutine is flushing its queue.
+func (a *Agent) enqueue(id int64, p []byte) {
+	a.qmu.Lock()
+	if a.closed.Load() {
+		a.qmu.Unlock()
+		return
+	}
+	if len(a.queue) >= a.message.cfg.SendQueue {
+		a.qmu.Unlock()
+		if a.message.cfg.SlowPolicy == SlowDisconnect {
+			// enqueue may run on the backplane writer, which Evict publishes
+			// to, so evict from another goroutine.
+			go a.message.Evict(a)
+		} else {
+			a.message.dropped.Add(1)
+		}
+		return
+	}
+	a.queue = append(a.queue, outbound{id, p})
+	a.message.queued.Add(1)
+	start := !a.flushing
+	a.flushing = true
+	a.qmu.Unlock()
+
+	// The pool only refuses work once it is closed, and then nobody is left
+	// to write the queue.
+	if start && a.message.pool.Schedule(a.flush) != nil {
+		a.discard()
+	}
+}
+
+// flush writes queued frames until the queue is empty.
+func (a *Agent) flush() {
+	for {
+		a.qmu.Lock()
+		if len(a.queue) == 0 {
+			a.flushing = false
+			a.qmu.Unlock()
+			return
+		}
+		p := a.queue[0]
+		a.queue[0] = outbound{}
+		a.queue = a.queue[1:]
+		a.qmu.Unlock()
+
+		a.message.queued.Add(-1)
+
+		if err := a.writeRaw(p.bts); err != nil {
+			a.message.Evict(a)
+			a.qmu.Lock()
+			a.flushing = false
+			a.qmu.Unlock()
+			return
+		}
+	}
+}
+
+// resume starts flushing the queue of an agent registered as held, dropping
+// the events up to id that were already written to it.
+func (a *Agent) resume(id int64) {
+	a.qmu.Lock()
+	kept := a.queue[:0]
+	for _, p := range a.queue {
+		if p.id == 0 || p.id > id {
+			kept = append(kept, p)
+		}
+	}
+	a.message.queued.Add(int64(len(kept) - len(a.queue)))
+	a.queue = kept
+	start := len(a.queue) > 0
+	a.flushing = start
+	a.qmu.Unlock()
+
+	// The pool only refuses work once it is closed, and then nobody is left
+	// to write the queue.
+	if start && a.message.pool.Schedule(a.flush) != nil {
+		a.discard()
+	}
+}
+
+// OnClose sets a function called once when the hub evicts the agent, so the
+// caller can release resources tied to the connection.
+func (a *Agent) OnClose(fn func()) {
+	a.qmu.Lock()
+	a.onClose = fn
+	a.qmu.Unlock()
+}
+
+// discard drops the agent's queued frames and stops accepting new ones.
+func (a *Agent) discard() {
+	a.closed.Store(true)
+
+	a.qmu.Lock()
+	a.message.queued.Add(-int64(len(a.queue)))
+	a.queue = nil
+	a.qmu.Unlock()
+}
+
+// touch records that the agent was heard from.
+func (a *Agent) touch() {
+	a.lastSeen.Store(time.Now().UnixNano())
+}
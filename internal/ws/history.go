@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultHistoryLimit is the number of messages returned by history when
+	// the client does not ask for a specific amount.
+	DefaultHistoryLimit = 50
+
+	// MaxHistoryLimit caps the number of messages returned by a single
+	// history call.
+	MaxHistoryLimit = 100
+)
+
+func historyLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		return MaxHistoryLimit
+	}
+	return limit
+}
+
+// Record is a published message as stored in the messages table. Messages
+// sent to everyone have no ConversationID.
+type Record struct {
+	ID             int64     `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	Author         string    `json:"author"`
+	UserID         int64     `json:"user_id"`
+	ConversationID int64     `json:"conversation_id,omitempty"`
+	Room           string    `json:"room,omitempty"`
+	Params         Object    `json:"params"`
+}
+
+type MessageModel struct {
+	DB *sql.DB
+}
+
+func (m MessageModel) Insert(record *Record) error {
+	params, err := json.Marshal(record.Params)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO messages (author, user_id, params, conversation_id, room)
+	VALUES ($1, $2, $3, NULLIF($4, 0), $5)
+	RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, record.Author, record.UserID, params, record.ConversationID, record.Room).Scan(&record.ID, &record.CreatedAt)
+}
+
+func (m MessageModel) Get(id int64) (*Record, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+	SELECT id, created_at, author, COALESCE(user_id, 0), COALESCE(conversation_id, 0), room, params
+	FROM messages
+	WHERE id = $1`
+
+	var (
+		record Record
+		params []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&record.ID,
+		&record.CreatedAt,
+		&record.Author,
+		&record.UserID,
+		&record.ConversationID,
+		&record.Room,
+		&params,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(params, &record.Params); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// GetAfter returns up to limit messages of the room or conversation with an
+// id greater than cursor, oldest first. An empty room and zero conversationID
+// select messages sent to everyone, and a zero cursor returns the most recent
+// messages.
+func (m MessageModel) GetAfter(room string, conversationID int64, cursor int64, limit int) ([]*Record, error) {
+	query := `
+	SELECT id, created_at, author, COALESCE(user_id, 0), COALESCE(conversation_id, 0), room, params
+	FROM messages
+	WHERE id > $1
+	AND conversation_id IS NOT DISTINCT FROM NULLIF($3, 0)
+	AND room = $4
+	ORDER BY id ASC
+	LIMIT $2`
+
+	if cursor <= 0 {
+		query = `
+		SELECT id, created_at, author, COALESCE(user_id, 0), COALESCE(conversation_id, 0), room, params
+		FROM (
+			SELECT id, created_at, author, user_id, conversation_id, room, params
+			FROM messages
+			WHERE id > $1
+			AND conversation_id IS NOT DISTINCT FROM NULLIF($3, 0)
+			AND room = $4
+			ORDER BY id DESC
+			LIMIT $2
+		) AS latest
+		ORDER BY id ASC`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, cursor, limit, conversationID, room)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*Record{}
+
+	for rows.Next() {
+		var (
+			record Record
+			params []byte
+		)
+
+		err := rows.Scan(&record.ID, &record.CreatedAt, &record.Author, &record.UserID, &record.ConversationID, &record.Room, &params)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(params, &record.Params); err != nil {
+			return nil, err
+		}
+
+		records = append(records, &record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
@@ -1,16 +1,15 @@
 package ws
 
 import (
-	"bytes"
-	"encoding/json"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/pistolricks/go-api-template/internal/pool"
+	"golang.org/x/time/rate"
+	"io"
 	"math/rand"
-	"net"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,70 +18,186 @@ type Message struct {
 	seq   int64
 	agent []*Agent
 	ns    map[string]*Agent
-
-	pool *gopool.Pool
-	out  chan []byte
+	users map[int64][]*Agent
+	rooms map[string]map[*Agent]struct{}
+
+	// presence holds the status of users per hub instance, as announced on
+	// the backplane, and peers the instances heard from.
+	presence map[int64]map[string]instanceStatus
+	peers    map[string]*peer
+	// gen numbers the presence snapshots of this instance.
+	gen atomic.Int64
+
+	// blocks holds the users blocked by each user with local agents.
+	blocks map[int64]map[int64]struct{}
+
+	lmu      sync.Mutex
+	limiters map[int64]*rate.Limiter // guarded by lmu
+
+	pool      *gopool.Pool
+	backplane Backplane
+	instance  string
+	models    Ws
+	cfg       Config
+	done      chan struct{}
+	closeOnce sync.Once
+
+	queued    atomic.Int64
+	dropped   atomic.Int64
+	evictions atomic.Int64
 }
 
-func NewMessage(pool *gopool.Pool) *Message {
+func NewMessage(pool *gopool.Pool, models Ws, backplane Backplane, cfg Config) *Message {
+	if cfg.SendQueue <= 0 {
+		cfg.SendQueue = 64
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = 2 * cfg.PingInterval
+	}
+	if cfg.PresenceInterval <= 0 {
+		cfg.PresenceInterval = 30 * time.Second
+	}
+	if cfg.PresenceTTL <= 0 {
+		cfg.PresenceTTL = 3 * cfg.PresenceInterval
+	}
+
 	message := &Message{
-		pool: pool,
-		ns:   make(map[string]*Agent),
-		out:  make(chan []byte, 1),
+		pool:      pool,
+		ns:        make(map[string]*Agent),
+		users:     make(map[int64][]*Agent),
+		rooms:     make(map[string]map[*Agent]struct{}),
+		presence:  make(map[int64]map[string]instanceStatus),
+		peers:     make(map[string]*peer),
+		blocks:    make(map[int64]map[int64]struct{}),
+		limiters:  make(map[int64]*rate.Limiter),
+		backplane: backplane,
+		instance:  newInstanceID(),
+		models:    models,
+		cfg:       cfg,
+		done:      make(chan struct{}),
 	}
 
 	go message.writer()
+	go message.refreshPresence()
+
+	if cfg.PingInterval > 0 {
+		go message.heartbeat()
+	}
+
+	// Learn the presence of the users connected to the other instances.
+	go message.requestSync()
 
 	return message
 }
 
-// Register registers new connection as a Agent.
-func (m *Message) Register(conn net.Conn) *Agent {
+// Client describes the user and negotiated settings of a new connection.
+type Client struct {
+	UserID int64
+	Name   string
+	// Permissions are the user's permission codes, checked before each
+	// method call.
+	Permissions []string
+	// Codec encodes the messages of the connection; JSON when nil.
+	Codec Codec
+	// Compress is set when permessage-deflate was negotiated.
+	Compress bool
+	// Stream is set for server-sent events streams, which are registered
+	// held: their queue is not flushed until they are resumed.
+	Stream bool
+}
+
+// Register registers new connection of the given user as a Agent. The
+// user's display name is used as the agent name, suffixed when it is already
+// taken by another connection. When the agent cannot be greeted it is
+// removed again and the error returned.
+func (m *Message) Register(conn io.ReadWriteCloser, client Client) (*Agent, error) {
+	if client.Codec == nil {
+		client.Codec = JSON
+	}
+
+	blocked, err := m.models.Blocks.GetAllForUser(client.UserID)
+	if err != nil {
+		return nil, err
+	}
 
 	agent := &Agent{
-		message: m,
-		conn:    conn,
+		message:     m,
+		conn:        conn,
+		userID:      client.UserID,
+		permissions: client.Permissions,
+		codec:       client.Codec,
+		compress:    client.Compress,
+		stream:      client.Stream,
+		flushing:    client.Stream,
 	}
+	agent.touch()
+
+	var prev, status string
 
 	m.mu.Lock()
 	{
 		agent.id = m.seq
-		agent.name = m.randName()
-
+		agent.name = m.uniqueName(client.Name)
+
+		prev = m.status(agent.userID)
+		if _, ok := m.blocks[agent.userID]; !ok {
+			m.blocks[agent.userID] = make(map[int64]struct{}, len(blocked))
+			for _, id := range blocked {
+				m.blocks[agent.userID][id] = struct{}{}
+			}
+		}
 		m.agent = append(m.agent, agent)
 		m.ns[agent.name] = agent
+		m.users[agent.userID] = append(m.users[agent.userID], agent)
+		status = m.status(agent.userID)
 
 		m.seq++
 	}
 	m.mu.Unlock()
 
-	err := agent.writeNotice("hello", Object{
-		"name": agent.name,
+	err = agent.writeNotice("hello", Object{
+		"name":    agent.name,
+		"user_id": agent.userID,
 	})
-	if err != nil {
-		return nil
+	if err == nil {
+		err = m.Broadcast("greet", Object{
+			"name":    agent.name,
+			"user_id": agent.userID,
+			"time":    timestamp(),
+		})
+	}
+	if err == nil && status != prev {
+		err = m.presenceChanged(agent.userID, status)
 	}
-	err = m.Broadcast("greet", Object{
-		"name": agent.name,
-		"time": timestamp(),
-	})
 	if err != nil {
-		return nil
+		m.Remove(agent)
+		return nil, err
 	}
 
-	return agent
+	return agent, nil
 }
 
 // Remove removes agent from message.
 func (m *Message) Remove(agent *Agent) {
 	m.mu.Lock()
+	prev := m.status(agent.userID)
 	removed := m.remove(agent)
+	status := m.status(agent.userID)
 	m.mu.Unlock()
 
 	if !removed {
 		return
 	}
 
+	agent.discard()
+
+	if status != prev {
+		err := m.presenceChanged(agent.userID, status)
+		if err != nil {
+			return
+		}
+	}
+
 	err := m.Broadcast("goodbye", Object{
 		"name": agent.name,
 		"time": timestamp(),
@@ -92,6 +207,29 @@ func (m *Message) Remove(agent *Agent) {
 	}
 }
 
+// Close sends a close frame to every connected agent and closes their
+// connections. It is called when the server shuts down.
+func (m *Message) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+
+	m.mu.RLock()
+	us := make([]*Agent, len(m.agent))
+	copy(us, m.agent)
+	m.mu.RUnlock()
+
+	frame := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "server shutting down"))
+
+	for _, u := range us {
+		if !u.stream {
+			u.io.Lock()
+			ws.WriteFrame(u.conn, frame)
+			u.io.Unlock()
+		}
+
+		u.conn.Close()
+	}
+}
+
 // Rename renames agent.
 func (m *Message) Rename(agent *Agent, name string) (prev string, ok bool) {
 	m.mu.Lock()
@@ -108,43 +246,169 @@ func (m *Message) Rename(agent *Agent, name string) (prev string, ok bool) {
 	return prev, ok
 }
 
-// Broadcast sends message to all alive agents.
-func (m *Message) Broadcast(method string, params Object) error {
-	var buf bytes.Buffer
+// Publish stores params as a message written by agent and broadcasts it to
+// the members of room, or to all alive agents when room is empty. agent must
+// have joined room.
+func (m *Message) Publish(agent *Agent, room string, params Object) (*Record, error) {
+	if room != "" && !m.InRoom(agent, room) {
+		return nil, ErrNotMember
+	}
 
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	encoder := json.NewEncoder(w)
+	err := m.filter(params)
+	if err != nil {
+		return nil, err
+	}
 
-	r := Request{Method: method, Params: params}
-	if err := encoder.Encode(r); err != nil {
-		return err
+	params["author"] = agent.name
+	params["user_id"] = agent.userID
+	params["time"] = timestamp()
+	if room != "" {
+		params["room"] = room
 	}
-	if err := w.Flush(); err != nil {
-		return err
+
+	record := &Record{
+		Author: agent.name,
+		UserID: agent.userID,
+		Room:   room,
+		Params: params,
 	}
 
-	m.out <- buf.Bytes()
+	err = m.models.Messages.Insert(record)
+	if err != nil {
+		return nil, err
+	}
+
+	params["id"] = record.ID
 
-	return nil
+	return record, m.publish(&Envelope{
+		Origin: m.instance,
+		Room:   room,
+		From:   agent.userID,
+		Method: "publish",
+		Params: params,
+	})
 }
 
-// writer writes broadcast messages from message.out channel.
+// History returns up to limit stored messages published to room after cursor.
+// agent must have joined room.
+func (m *Message) History(agent *Agent, room string, cursor int64, limit int) ([]*Record, error) {
+	if room != "" && !m.InRoom(agent, room) {
+		return nil, ErrNotMember
+	}
+
+	return m.models.Messages.GetAfter(room, 0, cursor, historyLimit(limit))
+}
+
+// Broadcast sends message to all alive agents.
+func (m *Message) Broadcast(method string, params Object) error {
+	return m.BroadcastRoom("", method, params)
+}
+
+// BroadcastRoom sends message to all alive agents that joined room. An empty
+// room sends it to all alive agents.
+func (m *Message) BroadcastRoom(room string, method string, params Object) error {
+	return m.publish(&Envelope{
+		Origin: m.instance,
+		Room:   room,
+		Method: method,
+		Params: params,
+	})
+}
+
+// publish stores env as an event, unless it is ephemeral, and hands it to the
+// backplane.
+func (m *Message) publish(env *Envelope) error {
+	if !ephemeral[env.Method] {
+		err := m.models.Events.Insert(env)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.backplane.Publish(env)
+}
+
+// writer writes envelopes received from the backplane to the local agents
+// they are addressed to.
 func (m *Message) writer() {
-	for bts := range m.out {
+	for env := range m.backplane.Envelopes() {
+		if env.Presence != nil {
+			m.applyPresence(env.Origin, env.Gen, env.Presence)
+			continue
+		}
+		if env.Snapshot != nil {
+			m.applySnapshot(env.Origin, env.Snapshot)
+			continue
+		}
+		if env.Sync {
+			// Both publish to the backplane this goroutine reads.
+			if env.Origin == "" {
+				go m.requestSync()
+			} else {
+				go m.publishSnapshot()
+			}
+			continue
+		}
+		if env.Block != nil {
+			m.applyBlock(env.Block)
+			continue
+		}
+
+		n := newNotice(env.ID, env.Method, env.Params)
+
 		m.mu.RLock()
-		us := m.agent
+		var us []*Agent
+		switch {
+		case env.Room != "":
+			us = make([]*Agent, 0, len(m.rooms[env.Room]))
+			for u := range m.rooms[env.Room] {
+				us = append(us, u)
+			}
+		case env.Users != nil:
+			for _, id := range env.Users {
+				us = append(us, m.users[id]...)
+			}
+		default:
+			us = m.agent
+		}
+		if env.From != 0 {
+			us = m.unblocked(us, env.From)
+		}
 		m.mu.RUnlock()
 
-		for _, u := range us {
-			u := u // For closure.
-			m.pool.Schedule(func() {
-				err := u.writeRaw(bts)
-				if err != nil {
-					return
-				}
-			})
+		m.deliver(us, n)
+
+		if env.Disconnect {
+			for _, u := range us {
+				// Evict publishes to the backplane this goroutine reads.
+				go m.Evict(u)
+			}
+		}
+	}
+}
+
+// deliver queues the notice for each of the agents, encoding it once for
+// each codec in use.
+func (m *Message) deliver(us []*Agent, n *notice) {
+	for _, u := range us {
+		bts, err := n.frame(u)
+		if err != nil {
+			continue
+		}
+		u.enqueue(n.id, bts)
+	}
+}
+
+// unblocked returns the agents whose users did not block from.
+// mutex must be held.
+func (m *Message) unblocked(us []*Agent, from int64) []*Agent {
+	kept := make([]*Agent, 0, len(us))
+	for _, u := range us {
+		if _, blocked := m.blocks[u.userID][from]; !blocked {
+			kept = append(kept, u)
 		}
 	}
+	return kept
 }
 
 // mutex must be held.
@@ -155,6 +419,27 @@ func (m *Message) remove(agent *Agent) bool {
 
 	delete(m.ns, agent.name)
 
+	for room := range agent.rooms {
+		m.leave(agent, room)
+	}
+
+	others := make([]*Agent, 0, len(m.users[agent.userID]))
+	for _, a := range m.users[agent.userID] {
+		if a != agent {
+			others = append(others, a)
+		}
+	}
+	if len(others) == 0 {
+		delete(m.users, agent.userID)
+		delete(m.blocks, agent.userID)
+
+		m.lmu.Lock()
+		delete(m.limiters, agent.userID)
+		m.lmu.Unlock()
+	} else {
+		m.users[agent.userID] = others
+	}
+
 	i := sort.Search(len(m.agent), func(i int) bool {
 		return m.agent[i].id >= agent.id
 	})
@@ -170,6 +455,23 @@ func (m *Message) remove(agent *Agent) bool {
 	return true
 }
 
+// uniqueName returns name, or name with a numeric suffix if it is already
+// registered. An empty name falls back to a random animal name.
+// mutex must be held.
+func (m *Message) uniqueName(name string) string {
+	if name == "" {
+		return m.randName()
+	}
+
+	candidate := name
+	for i := 2; ; i++ {
+		if _, has := m.ns[candidate]; !has {
+			return candidate
+		}
+		candidate = name + " " + strconv.Itoa(i)
+	}
+}
+
 func (m *Message) randName() string {
 	var suffix string
 	for {
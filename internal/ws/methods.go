@@ -0,0 +1,275 @@
+package ws
+
+import (
+	"github.com/pistolricks/validation"
+)
+
+// MaxTextLength is the largest message text, in bytes, accepted by publish
+// and send.
+const MaxTextLength = 4096
+
+// methods is the registry of methods clients may call.
+var methods = map[string]method{
+	"rename":   {permission: PermissionMessagesWrite, limited: true, call: handler(rename)},
+	"join":     {permission: PermissionMessagesRead, call: handler(join)},
+	"leave":    {permission: PermissionMessagesRead, call: handler(leave)},
+	"publish":  {permission: PermissionMessagesWrite, limited: true, call: handler(publish)},
+	"send":     {permission: PermissionMessagesWrite, limited: true, call: handler(send)},
+	"presence": {permission: PermissionMessagesRead, call: handler(presence)},
+	"typing":   {permission: PermissionMessagesWrite, call: handler(typing)},
+	"read":     {permission: PermissionMessagesRead, call: handler(read)},
+	"history":  {permission: PermissionMessagesRead, call: handler(history)},
+	"block":    {permission: PermissionMessagesRead, call: handler(block)},
+	"unblock":  {permission: PermissionMessagesRead, call: handler(unblock)},
+	"report":   {permission: PermissionMessagesRead, limited: true, call: handler(report)},
+}
+
+type renameParams struct {
+	Name string `json:"name"`
+}
+
+func (p *renameParams) Validate(v *validation.Validator) {
+	v.Check(p.Name != "", "name", "must be provided")
+	v.Check(len(p.Name) <= 500, "name", "must not be more than 500 bytes long")
+}
+
+func rename(a *Agent, p *renameParams) (any, error) {
+	err := a.message.filter(Object{"name": p.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	prev, ok := a.message.Rename(a, p.Name)
+	if !ok {
+		return nil, &ErrorObject{Code: CodeConflict, Message: "name already exists"}
+	}
+
+	err = a.message.Broadcast("rename", Object{
+		"prev": prev,
+		"name": p.Name,
+		"time": timestamp(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type roomParams struct {
+	Room string `json:"room"`
+}
+
+func (p *roomParams) Validate(v *validation.Validator) {
+	ValidateRoom(v, p.Room)
+}
+
+func join(a *Agent, p *roomParams) (any, error) {
+	changed, err := a.message.Join(a, p.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"room": p.Room, "changed": changed}, nil
+}
+
+func leave(a *Agent, p *roomParams) (any, error) {
+	changed, err := a.message.Leave(a, p.Room)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"room": p.Room, "changed": changed}, nil
+}
+
+type publishParams struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+func (p *publishParams) Validate(v *validation.Validator) {
+	if p.Room != "" {
+		ValidateRoom(v, p.Room)
+	}
+	validateText(v, p.Text)
+}
+
+func publish(a *Agent, p *publishParams) (any, error) {
+	record, err := a.message.Publish(a, p.Room, Object{"text": p.Text})
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"id": record.ID}, nil
+}
+
+type sendParams struct {
+	To           int64  `json:"to"`
+	Conversation int64  `json:"conversation"`
+	Text         string `json:"text"`
+}
+
+func (p *sendParams) Validate(v *validation.Validator) {
+	v.Check(p.To > 0 || p.Conversation > 0, "to", "must be provided unless conversation is")
+	v.Check(p.To >= 0, "to", "must be a positive integer")
+	v.Check(p.Conversation >= 0, "conversation", "must be a positive integer")
+	validateText(v, p.Text)
+}
+
+func send(a *Agent, p *sendParams) (any, error) {
+	record, err := a.message.Send(a, p.Conversation, p.To, Object{"text": p.Text})
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"id": record.ID, "conversation": record.ConversationID}, nil
+}
+
+type presenceParams struct {
+	Status string `json:"status"`
+}
+
+func (p *presenceParams) Validate(v *validation.Validator) {
+	v.Check(validation.PermittedValue(p.Status, StatusOnline, StatusAway), "status", "must be online or away")
+}
+
+func presence(a *Agent, p *presenceParams) (any, error) {
+	err := a.message.SetAway(a, p.Status == StatusAway)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"status": a.message.Status(a.userID)}, nil
+}
+
+type typingParams struct {
+	Conversation int64 `json:"conversation"`
+}
+
+func (p *typingParams) Validate(v *validation.Validator) {
+	v.Check(p.Conversation > 0, "conversation", "must be a positive integer")
+}
+
+func typing(a *Agent, p *typingParams) (any, error) {
+	return nil, a.message.Typing(a, p.Conversation)
+}
+
+type readParams struct {
+	Message int64 `json:"message"`
+}
+
+func (p *readParams) Validate(v *validation.Validator) {
+	v.Check(p.Message > 0, "message", "must be a positive integer")
+}
+
+func read(a *Agent, p *readParams) (any, error) {
+	receipt, err := a.message.Read(a, p.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"message": receipt.MessageID, "read_at": receipt.ReadAt}, nil
+}
+
+type historyParams struct {
+	Room         string `json:"room"`
+	Conversation int64  `json:"conversation"`
+	Cursor       int64  `json:"cursor"`
+	Limit        int    `json:"limit"`
+}
+
+func (p *historyParams) Validate(v *validation.Validator) {
+	if p.Room != "" {
+		ValidateRoom(v, p.Room)
+	}
+	v.Check(p.Room == "" || p.Conversation == 0, "conversation", "must not be provided with room")
+	v.Check(p.Conversation >= 0, "conversation", "must be a positive integer")
+	v.Check(p.Cursor >= 0, "cursor", "must not be negative")
+	v.Check(p.Limit >= 0 && p.Limit <= MaxHistoryLimit, "limit", "must be between 0 and 100")
+}
+
+func history(a *Agent, p *historyParams) (any, error) {
+	var (
+		records []*Record
+		err     error
+	)
+
+	if p.Conversation > 0 {
+		records, err = a.message.ConversationHistory(a, p.Conversation, p.Cursor, p.Limit)
+	} else {
+		records, err = a.message.History(a, p.Room, p.Cursor, p.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	next := p.Cursor
+	if len(records) > 0 {
+		next = records[len(records)-1].ID
+	}
+
+	return Object{"messages": records, "cursor": next}, nil
+}
+
+type blockParams struct {
+	User int64 `json:"user"`
+}
+
+func (p *blockParams) Validate(v *validation.Validator) {
+	v.Check(p.User > 0, "user", "must be a positive integer")
+}
+
+func block(a *Agent, p *blockParams) (any, error) {
+	if p.User == a.userID {
+		return nil, &ErrorObject{Code: CodeInvalidParams, Message: "invalid params", Data: map[string]string{"user": "must not be yourself"}}
+	}
+
+	err := a.message.SetBlocked(a, p.User, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"user": p.User, "blocked": true}, nil
+}
+
+func unblock(a *Agent, p *blockParams) (any, error) {
+	err := a.message.SetBlocked(a, p.User, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"user": p.User, "blocked": false}, nil
+}
+
+type reportParams struct {
+	User    int64  `json:"user"`
+	Message int64  `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func (p *reportParams) Validate(v *validation.Validator) {
+	v.Check(p.User > 0 || p.Message > 0, "user", "must be provided unless message is")
+	v.Check(p.User >= 0, "user", "must be a positive integer")
+	v.Check(p.Message >= 0, "message", "must be a positive integer")
+	v.Check(p.Reason != "", "reason", "must be provided")
+}
+
+func report(a *Agent, p *reportParams) (any, error) {
+	r := &Report{
+		UserID:    p.User,
+		MessageID: p.Message,
+		Reason:    p.Reason,
+	}
+
+	err := a.message.Report(a, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return Object{"id": r.ID, "status": r.Status}, nil
+}
+
+func validateText(v *validation.Validator, text string) {
+	v.Check(text != "", "text", "must be provided")
+	v.Check(len(text) <= MaxTextLength, "text", "must not be more than 4096 bytes long")
+}
@@ -0,0 +1,452 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pistolricks/validation"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrRateLimited = errors.New("rate limit exceeded")
+	ErrBlocked     = errors.New("blocked by the recipient")
+)
+
+// Report statuses.
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// Block is a change to the users blocked by UserID, travelling through the
+// backplane so every instance filters the same senders.
+type Block struct {
+	UserID    int64 `json:"user_id"`
+	BlockedID int64 `json:"blocked_id"`
+	Blocked   bool  `json:"blocked"`
+}
+
+// Report is an abuse report filed by a user against another user or one of
+// their messages.
+type Report struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReporterID int64      `json:"reporter_id"`
+	UserID     int64      `json:"user_id"`
+	MessageID  int64      `json:"message_id,omitempty"`
+	Reason     string     `json:"reason"`
+	Status     string     `json:"status"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy int64      `json:"resolved_by,omitempty"`
+}
+
+func ValidateReport(v *validation.Validator, report *Report) {
+	v.Check(report.Reason != "", "reason", "must be provided")
+	v.Check(len(report.Reason) <= 1000, "reason", "must not be more than 1000 bytes long")
+	v.Check(report.UserID != report.ReporterID, "user", "must not be yourself")
+}
+
+func ValidateReportStatus(v *validation.Validator, status string) {
+	v.Check(validation.PermittedValue(status, ReportOpen, ReportResolved, ReportDismissed), "status", "must be open, resolved or dismissed")
+}
+
+// Ban keeps a user out of chat until ExpiresAt, or for good when it is nil.
+type Ban struct {
+	UserID    int64      `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	BannedBy  int64      `json:"banned_by,omitempty"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func ValidateBan(v *validation.Validator, ban *Ban) {
+	v.Check(ban.Reason != "", "reason", "must be provided")
+	v.Check(len(ban.Reason) <= 1000, "reason", "must not be more than 1000 bytes long")
+	v.Check(ban.ExpiresAt == nil || ban.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	v.Check(ban.UserID != ban.BannedBy, "user", "must not be yourself")
+}
+
+type BlockModel struct {
+	DB *sql.DB
+}
+
+func (m BlockModel) Insert(userID, blockedID int64) error {
+	query := `
+	INSERT INTO user_blocks (user_id, blocked_id)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, blockedID)
+	if foreignKeyViolation(err) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+func (m BlockModel) Delete(userID, blockedID int64) error {
+	query := `
+	DELETE FROM user_blocks
+	WHERE user_id = $1 AND blocked_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, blockedID)
+	return err
+}
+
+// Exists reports whether userID blocked blockedID.
+func (m BlockModel) Exists(userID, blockedID int64) (bool, error) {
+	query := `
+	SELECT EXISTS (SELECT 1 FROM user_blocks WHERE user_id = $1 AND blocked_id = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, userID, blockedID).Scan(&exists)
+	return exists, err
+}
+
+// GetAllForUser returns the ids of the users blocked by userID.
+func (m BlockModel) GetAllForUser(userID int64) ([]int64, error) {
+	query := `
+	SELECT blocked_id
+	FROM user_blocks
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+type ReportModel struct {
+	DB *sql.DB
+}
+
+func (m ReportModel) Insert(report *Report) error {
+	query := `
+	INSERT INTO reports (reporter_id, user_id, message_id, reason)
+	VALUES ($1, $2, NULLIF($3, 0), $4)
+	RETURNING id, created_at, status`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, report.ReporterID, report.UserID, report.MessageID, report.Reason).Scan(&report.ID, &report.CreatedAt, &report.Status)
+	if foreignKeyViolation(err) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+// GetAll returns the reports with the given status, oldest first.
+func (m ReportModel) GetAll(status string, limit, offset int) ([]*Report, error) {
+	query := `
+	SELECT id, created_at, reporter_id, user_id, COALESCE(message_id, 0), reason, status, resolved_at, COALESCE(resolved_by, 0)
+	FROM reports
+	WHERE status = $1
+	ORDER BY id ASC
+	LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []*Report{}
+
+	for rows.Next() {
+		var report Report
+
+		err := rows.Scan(
+			&report.ID,
+			&report.CreatedAt,
+			&report.ReporterID,
+			&report.UserID,
+			&report.MessageID,
+			&report.Reason,
+			&report.Status,
+			&report.ResolvedAt,
+			&report.ResolvedBy,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		reports = append(reports, &report)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// SetStatus sets the status of the report, recording who resolved it.
+func (m ReportModel) SetStatus(id int64, status string, by int64) (*Report, error) {
+	query := `
+	UPDATE reports
+	SET status = $2,
+	    resolved_at = CASE WHEN $2 = 'open' THEN NULL ELSE NOW() END,
+	    resolved_by = CASE WHEN $2 = 'open' THEN NULL ELSE $3::bigint END
+	WHERE id = $1
+	RETURNING id, created_at, reporter_id, user_id, COALESCE(message_id, 0), reason, status, resolved_at, COALESCE(resolved_by, 0)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var report Report
+
+	err := m.DB.QueryRowContext(ctx, query, id, status, by).Scan(
+		&report.ID,
+		&report.CreatedAt,
+		&report.ReporterID,
+		&report.UserID,
+		&report.MessageID,
+		&report.Reason,
+		&report.Status,
+		&report.ResolvedAt,
+		&report.ResolvedBy,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+type BanModel struct {
+	DB *sql.DB
+}
+
+// Upsert bans the user, replacing any previous ban. It returns
+// ErrRecordNotFound when the user does not exist.
+func (m BanModel) Upsert(ban *Ban) error {
+	query := `
+	INSERT INTO chat_bans (user_id, banned_by, reason, expires_at)
+	VALUES ($1, NULLIF($2, 0), $3, $4)
+	ON CONFLICT (user_id) DO UPDATE
+	SET created_at = NOW(), banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason, expires_at = EXCLUDED.expires_at
+	RETURNING created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ban.UserID, ban.BannedBy, ban.Reason, ban.ExpiresAt).Scan(&ban.CreatedAt)
+	if err != nil {
+		if foreignKeyViolation(err) {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m BanModel) Delete(userID int64) error {
+	query := `
+	DELETE FROM chat_bans
+	WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetActive returns the ban of the user if it has not expired.
+func (m BanModel) GetActive(userID int64) (*Ban, error) {
+	query := `
+	SELECT user_id, created_at, COALESCE(banned_by, 0), reason, expires_at
+	FROM chat_bans
+	WHERE user_id = $1
+	AND (expires_at IS NULL OR expires_at > NOW())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ban Ban
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&ban.UserID, &ban.CreatedAt, &ban.BannedBy, &ban.Reason, &ban.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &ban, nil
+}
+
+// foreignKeyViolation reports whether err is a Postgres foreign key
+// violation, meaning a referenced user or message does not exist.
+func foreignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// allow reports whether the user may send another message under the hub's
+// rate limit.
+func (m *Message) allow(userID int64) bool {
+	if m.cfg.RateLimit <= 0 {
+		return true
+	}
+
+	m.lmu.Lock()
+	defer m.lmu.Unlock()
+
+	limiter, ok := m.limiters[userID]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(m.cfg.RateLimit), m.cfg.RateBurst)
+		m.limiters[userID] = limiter
+	}
+
+	return limiter.Allow()
+}
+
+// filter runs the hub's content filter on every string in params.
+func (m *Message) filter(params Object) error {
+	if m.cfg.Filter == nil {
+		return nil
+	}
+
+	for _, v := range params {
+		if s, ok := v.(string); ok {
+			if err := m.cfg.Filter.Check(s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetBlocked blocks or unblocks blockedID for agent's user. Blocked users
+// cannot start or continue direct conversations with the user, and their
+// messages to rooms and everyone are not delivered to them.
+func (m *Message) SetBlocked(agent *Agent, blockedID int64, blocked bool) error {
+	var err error
+	if blocked {
+		err = m.models.Blocks.Insert(agent.userID, blockedID)
+	} else {
+		err = m.models.Blocks.Delete(agent.userID, blockedID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.backplane.Publish(&Envelope{
+		Origin: m.instance,
+		Block: &Block{
+			UserID:    agent.userID,
+			BlockedID: blockedID,
+			Blocked:   blocked,
+		},
+	})
+}
+
+// applyBlock updates the senders blocked by a user with local agents.
+func (m *Message) applyBlock(b *Block) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blocked, ok := m.blocks[b.UserID]
+	if !ok {
+		return
+	}
+
+	if b.Blocked {
+		blocked[b.BlockedID] = struct{}{}
+	} else {
+		delete(blocked, b.BlockedID)
+	}
+}
+
+// Report files an abuse report from agent's user. The reported user is
+// taken from the message when one is given.
+func (m *Message) Report(agent *Agent, report *Report) error {
+	report.ReporterID = agent.userID
+
+	if report.MessageID > 0 {
+		record, err := m.models.Messages.Get(report.MessageID)
+		if err != nil {
+			return err
+		}
+		report.UserID = record.UserID
+	}
+
+	v := validation.New()
+	if ValidateReport(v, report); !v.Valid() {
+		return &ErrorObject{Code: CodeInvalidParams, Message: "invalid params", Data: v.Errors}
+	}
+
+	return m.models.Reports.Insert(report)
+}
+
+// Kick tells every connected agent of the user why it is being disconnected
+// and closes their connections, on every instance.
+func (m *Message) Kick(userID int64, reason string) error {
+	return m.backplane.Publish(&Envelope{
+		Origin:     m.instance,
+		Users:      []int64{userID},
+		Method:     "kicked",
+		Params:     Object{"reason": reason, "time": timestamp()},
+		Disconnect: true,
+	})
+}
@@ -0,0 +1,57 @@
+package ws
+
+import "errors"
+
+var (
+	// ErrNoContact is returned when a user may not start a conversation
+	// with another one.
+	ErrNoContact = errors.New("not allowed to message this user")
+	// ErrNoAccess is returned when a user may not join a room.
+	ErrNoAccess = errors.New("not allowed to join this room")
+)
+
+// Policy decides who users may talk to.
+type Policy interface {
+	// CanContact reports whether the user may start a conversation with the
+	// other user. Conversations that exist already need no permission.
+	CanContact(userID, otherID int64) (bool, error)
+	// CanJoin reports whether the user may join the room, and so read its
+	// history.
+	CanJoin(userID int64, room string) (bool, error)
+}
+
+// canContact returns ErrNoContact unless the policy lets the user start a
+// conversation with the other user. Without a policy no one may.
+func (m *Message) canContact(userID, otherID int64) error {
+	if m.cfg.Policy == nil {
+		return ErrNoContact
+	}
+
+	ok, err := m.cfg.Policy.CanContact(userID, otherID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoContact
+	}
+
+	return nil
+}
+
+// canJoin returns ErrNoAccess unless the policy lets the user join the room.
+// Without a policy no one may.
+func (m *Message) canJoin(userID int64, room string) error {
+	if m.cfg.Policy == nil {
+		return ErrNoAccess
+	}
+
+	ok, err := m.cfg.Policy.CanJoin(userID, room)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoAccess
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// Presence is the last known status of a user.
+type Presence struct {
+	UserID     int64     `json:"user_id"`
+	Status     string    `json:"status"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+type PresenceModel struct {
+	DB *sql.DB
+}
+
+func (m PresenceModel) Upsert(presence *Presence) error {
+	query := `
+	INSERT INTO presences (user_id, status)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET status = EXCLUDED.status, last_seen_at = NOW()
+	RETURNING last_seen_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, presence.UserID, presence.Status).Scan(&presence.LastSeenAt)
+}
+
+func (m PresenceModel) Get(userID int64) (*Presence, error) {
+	query := `
+	SELECT user_id, status, last_seen_at
+	FROM presences
+	WHERE user_id = $1`
+
+	var presence Presence
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&presence.UserID,
+		&presence.Status,
+		&presence.LastSeenAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &presence, nil
+}
+
+// SetAway marks a single connection of the user as away or back online. The
+// user is away only when all of their connections are.
+func (m *Message) SetAway(agent *Agent, away bool) error {
+	m.mu.Lock()
+	prev := m.status(agent.userID)
+	agent.away = away
+	status := m.status(agent.userID)
+	m.mu.Unlock()
+
+	if status == prev {
+		return nil
+	}
+
+	return m.presenceChanged(agent.userID, status)
+}
+
+// Status returns the current status of the user aggregated over all of their
+// connections on every hub instance.
+func (m *Message) Status(userID int64) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.aggregateStatus(userID)
+}
+
+// status returns the status of the user over the connections of this hub.
+// mutex must be held.
+func (m *Message) status(userID int64) string {
+	agents := m.users[userID]
+	if len(agents) == 0 {
+		return StatusOffline
+	}
+	for _, a := range agents {
+		if !a.away {
+			return StatusOnline
+		}
+	}
+	return StatusAway
+}
+
+// snapshotSize is the number of users per snapshot envelope, small enough
+// for a NOTIFY payload.
+const snapshotSize = 200
+
+// Snapshot is the presence of the users connected to an instance. Large
+// snapshots are split over several envelopes; once the Last one arrives the
+// users of older generations of the instance are forgotten.
+type Snapshot struct {
+	Gen      int64            `json:"gen"`
+	Statuses map[int64]string `json:"statuses,omitempty"`
+	Last     bool             `json:"last,omitempty"`
+}
+
+// instanceStatus is the status of a user on a hub instance, with the
+// snapshot generation of the instance it was announced in.
+type instanceStatus struct {
+	status string
+	gen    int64
+}
+
+// peer is another hub instance announcing presence on the backplane.
+type peer struct {
+	gen  int64
+	seen time.Time
+}
+
+// aggregateStatus returns the status of the user over all hub instances.
+// mutex must be held.
+func (m *Message) aggregateStatus(userID int64) string {
+	status := StatusOffline
+	for _, s := range m.presence[userID] {
+		switch s.status {
+		case StatusOnline:
+			return StatusOnline
+		case StatusAway:
+			status = StatusAway
+		}
+	}
+	return status
+}
+
+// setStatus records the status of the user on the instance and returns the
+// user's aggregated status when it changed, "" otherwise.
+// mutex must be held.
+func (m *Message) setStatus(origin string, userID int64, status string, gen int64) string {
+	prev := m.aggregateStatus(userID)
+	instances, ok := m.presence[userID]
+	if !ok {
+		instances = make(map[string]instanceStatus)
+		m.presence[userID] = instances
+	}
+	if status == StatusOffline {
+		delete(instances, origin)
+		if len(instances) == 0 {
+			delete(m.presence, userID)
+		}
+	} else {
+		instances[origin] = instanceStatus{status: status, gen: gen}
+	}
+	if next := m.aggregateStatus(userID); next != prev {
+		return next
+	}
+	return ""
+}
+
+// presenceChanged announces the user's status on this hub to all instances.
+func (m *Message) presenceChanged(userID int64, status string) error {
+	return m.backplane.Publish(&Envelope{
+		Origin: m.instance,
+		Gen:    m.gen.Load(),
+		Presence: &Presence{
+			UserID: userID,
+			Status: status,
+		},
+	})
+}
+
+// applyPresence records the status announced by a hub instance. When the
+// user's aggregated status changes, the instance that caused it stores the
+// new status and every instance notifies its agents.
+func (m *Message) applyPresence(origin string, gen int64, p *Presence) {
+	m.mu.Lock()
+	if origin != m.instance {
+		m.peer(origin).seen = time.Now()
+	}
+	status := m.setStatus(origin, p.UserID, p.Status, gen)
+	us := m.agent
+	m.mu.Unlock()
+
+	if status == "" {
+		return
+	}
+
+	m.announcePresence(us, p.UserID, status, origin == m.instance)
+}
+
+// applySnapshot records the presence announced by another hub instance.
+func (m *Message) applySnapshot(origin string, s *Snapshot) {
+	// The hub's own users are tracked as they connect.
+	if origin == m.instance {
+		return
+	}
+
+	changed := make(map[int64]string)
+
+	m.mu.Lock()
+	p := m.peer(origin)
+	p.seen = time.Now()
+	if s.Gen < p.gen {
+		m.mu.Unlock()
+		return
+	}
+	p.gen = s.Gen
+	for userID, status := range s.Statuses {
+		if next := m.setStatus(origin, userID, status, s.Gen); next != "" {
+			changed[userID] = next
+		}
+	}
+	if s.Last {
+		for userID, instances := range m.presence {
+			if st, ok := instances[origin]; ok && st.gen < s.Gen {
+				if next := m.setStatus(origin, userID, StatusOffline, s.Gen); next != "" {
+					changed[userID] = next
+				}
+			}
+		}
+	}
+	us := m.agent
+	m.mu.Unlock()
+
+	for userID, status := range changed {
+		m.announcePresence(us, userID, status, false)
+	}
+}
+
+// peer returns the instance, adding it when it was not heard from yet.
+// mutex must be held.
+func (m *Message) peer(origin string) *peer {
+	p, ok := m.peers[origin]
+	if !ok {
+		p = &peer{}
+		m.peers[origin] = p
+	}
+	return p
+}
+
+// expirePresence forgets the instances not heard from since before and
+// returns the users whose aggregated status changed.
+func (m *Message) expirePresence(before time.Time) ([]*Agent, map[int64]string) {
+	changed := make(map[int64]string)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for origin, p := range m.peers {
+		if !p.seen.Before(before) {
+			continue
+		}
+		delete(m.peers, origin)
+		for userID, instances := range m.presence {
+			if _, ok := instances[origin]; ok {
+				if next := m.setStatus(origin, userID, StatusOffline, 0); next != "" {
+					changed[userID] = next
+				}
+			}
+		}
+	}
+
+	return m.agent, changed
+}
+
+// refreshPresence announces the presence of the hub's users each
+// PresenceInterval, which keeps the instance alive for the others, and
+// expires the instances that stopped doing so.
+func (m *Message) refreshPresence() {
+	ticker := time.NewTicker(m.cfg.PresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.publishSnapshot()
+
+			us, changed := m.expirePresence(now.Add(-m.cfg.PresenceTTL))
+			for userID, status := range changed {
+				// No instance is left to store it, so each one does.
+				m.announcePresence(us, userID, status, true)
+			}
+		}
+	}
+}
+
+// publishSnapshot announces the presence of every user connected to this hub.
+func (m *Message) publishSnapshot() {
+	m.mu.RLock()
+	gen := m.gen.Add(1)
+	statuses := make(map[int64]string, len(m.users))
+	for userID := range m.users {
+		statuses[userID] = m.status(userID)
+	}
+	m.mu.RUnlock()
+
+	for {
+		s := &Snapshot{Gen: gen, Statuses: make(map[int64]string)}
+		for userID, status := range statuses {
+			if len(s.Statuses) == snapshotSize {
+				break
+			}
+			s.Statuses[userID] = status
+			delete(statuses, userID)
+		}
+		s.Last = len(statuses) == 0
+
+		err := m.backplane.Publish(&Envelope{Origin: m.instance, Snapshot: s})
+		if err != nil || s.Last {
+			return
+		}
+	}
+}
+
+// requestSync asks every instance, this one included, to publish a snapshot.
+func (m *Message) requestSync() {
+	err := m.backplane.Publish(&Envelope{Origin: m.instance, Sync: true})
+	if err != nil {
+		return
+	}
+}
+
+// announcePresence notifies the agents of the user's new aggregated status,
+// storing it first when store is set.
+func (m *Message) announcePresence(us []*Agent, userID int64, status string, store bool) {
+	presence := &Presence{
+		UserID:     userID,
+		Status:     status,
+		LastSeenAt: time.Now(),
+	}
+
+	if store {
+		m.pool.Schedule(func() {
+			err := m.models.Presences.Upsert(presence)
+			if err != nil {
+				return
+			}
+		})
+	}
+
+	m.deliver(us, newNotice(0, "presence", Object{
+		"user_id":      presence.UserID,
+		"status":       presence.Status,
+		"last_seen_at": presence.LastSeenAt,
+		"time":         timestamp(),
+	}))
+}
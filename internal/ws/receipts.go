@@ -0,0 +1,100 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Receipt records that a user has read a message.
+type Receipt struct {
+	MessageID int64     `json:"message_id"`
+	UserID    int64     `json:"user_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+type ReceiptModel struct {
+	DB *sql.DB
+}
+
+// Insert stores the receipt. Reading a message twice keeps the first read time.
+func (m ReceiptModel) Insert(receipt *Receipt) error {
+	query := `
+	INSERT INTO message_reads (message_id, user_id)
+	VALUES ($1, $2)
+	ON CONFLICT (message_id, user_id) DO UPDATE SET read_at = message_reads.read_at
+	RETURNING read_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, receipt.MessageID, receipt.UserID).Scan(&receipt.ReadAt)
+}
+
+// Typing notifies the other agents in the conversation that agent's user is
+// typing. Users who blocked them are not notified.
+func (m *Message) Typing(agent *Agent, conversationID int64) error {
+	conversation, err := m.models.Conversations.Get(conversationID)
+	if err != nil {
+		return err
+	}
+	if !conversation.Includes(agent.userID) {
+		return ErrRecordNotFound
+	}
+
+	return m.publish(&Envelope{
+		Origin: m.instance,
+		Users:  conversation.UserIDs,
+		From:   agent.userID,
+		Method: "typing",
+		Params: Object{
+			"conversation_id": conversation.ID,
+			"user_id":         agent.userID,
+			"name":            agent.name,
+			"time":            timestamp(),
+		},
+	})
+}
+
+// Read stores a read receipt for a direct message and notifies the
+// conversation participants who did not block agent's user.
+func (m *Message) Read(agent *Agent, messageID int64) (*Receipt, error) {
+	record, err := m.models.Messages.Get(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if record.ConversationID == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	conversation, err := m.models.Conversations.Get(record.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !conversation.Includes(agent.userID) {
+		return nil, ErrRecordNotFound
+	}
+
+	receipt := &Receipt{
+		MessageID: record.ID,
+		UserID:    agent.userID,
+	}
+
+	err = m.models.Receipts.Insert(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, m.publish(&Envelope{
+		Origin: m.instance,
+		Users:  conversation.UserIDs,
+		From:   agent.userID,
+		Method: "read",
+		Params: Object{
+			"conversation_id": conversation.ID,
+			"message_id":      record.ID,
+			"user_id":         agent.userID,
+			"read_at":         receipt.ReadAt,
+		},
+	})
+}
@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"github.com/pistolricks/validation"
+)
+
+// ValidateRoom checks that name can be used as a room name.
+func ValidateRoom(v *validation.Validator, name string) {
+	v.Check(name != "", "room", "must be provided")
+	v.Check(len(name) <= 100, "room", "must not be more than 100 bytes long")
+}
+
+// Join adds agent to room, if the policy lets its user join it, and notifies
+// its members. It reports false if agent already joined room.
+func (m *Message) Join(agent *Agent, room string) (bool, error) {
+	if m.InRoom(agent, room) {
+		return false, nil
+	}
+
+	err := m.canJoin(agent.userID, room)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	_, has := agent.rooms[room]
+	if !has {
+		members, ok := m.rooms[room]
+		if !ok {
+			members = make(map[*Agent]struct{})
+			m.rooms[room] = members
+		}
+		members[agent] = struct{}{}
+
+		if agent.rooms == nil {
+			agent.rooms = make(map[string]struct{})
+		}
+		agent.rooms[room] = struct{}{}
+	}
+	m.mu.Unlock()
+
+	if has {
+		return false, nil
+	}
+
+	err = m.BroadcastRoom(room, "join", Object{
+		"room":    room,
+		"name":    agent.name,
+		"user_id": agent.userID,
+		"time":    timestamp(),
+	})
+
+	return true, err
+}
+
+// Leave removes agent from room and notifies the remaining members. It
+// reports false if agent was not in room.
+func (m *Message) Leave(agent *Agent, room string) (bool, error) {
+	m.mu.Lock()
+	removed := m.leave(agent, room)
+	m.mu.Unlock()
+
+	if !removed {
+		return false, nil
+	}
+
+	err := m.BroadcastRoom(room, "leave", Object{
+		"room":    room,
+		"name":    agent.name,
+		"user_id": agent.userID,
+		"time":    timestamp(),
+	})
+
+	return true, err
+}
+
+// InRoom reports whether agent joined room.
+func (m *Message) InRoom(agent *Agent, room string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, has := agent.rooms[room]
+	return has
+}
+
+// Rooms returns the names of the rooms agent joined.
+func (m *Message) Rooms(agent *Agent) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rooms := make([]string, 0, len(agent.rooms))
+	for room := range agent.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// mutex must be held.
+func (m *Message) leave(agent *Agent, room string) bool {
+	if _, has := agent.rooms[room]; !has {
+		return false
+	}
+
+	delete(agent.rooms, room)
+
+	members := m.rooms[room]
+	delete(members, agent)
+	if len(members) == 0 {
+		delete(m.rooms, room)
+	}
+
+	return true
+}
@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/pistolricks/validation"
+)
+
+// Permission codes checked by the chat methods.
+const (
+	PermissionMessagesRead  = "messages:read"
+	PermissionMessagesWrite = "messages:write"
+
+	// PermissionMessagesModerate grants access to abuse reports and bans.
+	PermissionMessagesModerate = "messages:moderate"
+)
+
+// Params is implemented by the typed parameters of every method.
+type Params interface {
+	Validate(v *validation.Validator)
+}
+
+// method is an entry of the method registry.
+type method struct {
+	permission string
+	// limited methods count against the user's rate limit.
+	limited bool
+	call    func(a *Agent, raw json.RawMessage) (any, error)
+}
+
+// handler adapts fn to the registry: it decodes and validates the params
+// into a fresh P before calling fn.
+func handler[T any, P interface {
+	*T
+	Params
+}](fn func(a *Agent, p P) (any, error)) func(a *Agent, raw json.RawMessage) (any, error) {
+	return func(a *Agent, raw json.RawMessage) (any, error) {
+		p := P(new(T))
+
+		if len(raw) > 0 && !bytes.Equal(raw, []byte("null")) {
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(p); err != nil {
+				return nil, &ErrorObject{Code: CodeInvalidParams, Message: "invalid params", Data: err.Error()}
+			}
+		}
+
+		v := validation.New()
+		if p.Validate(v); !v.Valid() {
+			return nil, &ErrorObject{Code: CodeInvalidParams, Message: "invalid params", Data: v.Errors}
+		}
+
+		return fn(a, p)
+	}
+}
+
+// dispatch handles a single decoded request and returns the response to
+// write, or nil for notifications.
+func (a *Agent) dispatch(raw json.RawMessage) any {
+	req := &Request{}
+	if err := json.Unmarshal(raw, req); err != nil {
+		return errorResponse(nil, &ErrorObject{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+
+	if req.JSONRPC != Version || req.Method == "" || !validID(req.ID) {
+		return errorResponse(nil, &ErrorObject{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+
+	result, err := a.call(req)
+
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, rpcError(err))
+	}
+
+	return Response{JSONRPC: Version, ID: req.ID, Result: result}
+}
+
+// call looks the method up and checks the agent may use it.
+func (a *Agent) call(req *Request) (any, error) {
+	m, ok := methods[req.Method]
+	if !ok {
+		return nil, &ErrorObject{Code: CodeMethodNotFound, Message: "method not found"}
+	}
+
+	if m.permission != "" && !slices.Contains(a.permissions, m.permission) {
+		return nil, &ErrorObject{Code: CodeForbidden, Message: "your user account doesn't have the necessary permissions"}
+	}
+
+	if m.limited && !a.message.allow(a.userID) {
+		return nil, ErrRateLimited
+	}
+
+	return m.call(a, req.Params)
+}
+
+// handle decodes a frame holding a single request or a batch and returns
+// the response to write, or nil when there is nothing to answer.
+func (a *Agent) handle(p []byte) any {
+	p = bytes.TrimSpace(p)
+
+	if len(p) == 0 || p[0] != '[' {
+		if !json.Valid(p) {
+			return errorResponse(nil, &ErrorObject{Code: CodeParseError, Message: "parse error"})
+		}
+		return a.dispatch(p)
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(p, &batch); err != nil {
+		return errorResponse(nil, &ErrorObject{Code: CodeParseError, Message: "parse error"})
+	}
+	if len(batch) == 0 {
+		return errorResponse(nil, &ErrorObject{Code: CodeInvalidRequest, Message: "invalid request"})
+	}
+
+	responses := make([]any, 0, len(batch))
+	for _, raw := range batch {
+		if res := a.dispatch(raw); res != nil {
+			responses = append(responses, res)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+
+	return responses
+}
+
+// rpcError maps errors returned by the hub to JSON-RPC error objects.
+func rpcError(err error) *ErrorObject {
+	var e *ErrorObject
+
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, ErrRecordNotFound):
+		return &ErrorObject{Code: CodeNotFound, Message: "the requested resource could not be found"}
+	case errors.Is(err, ErrNotMember):
+		return &ErrorObject{Code: CodeNotMember, Message: "not a member of the room"}
+	case errors.Is(err, ErrBlocked), errors.Is(err, ErrNoContact), errors.Is(err, ErrNoAccess):
+		return &ErrorObject{Code: CodeForbidden, Message: err.Error()}
+	case errors.Is(err, ErrRateLimited):
+		return &ErrorObject{Code: CodeRateLimited, Message: err.Error()}
+	case errors.Is(err, ErrFiltered):
+		return &ErrorObject{Code: CodeRejected, Message: err.Error()}
+	default:
+		return &ErrorObject{Code: CodeInternalError, Message: "internal error"}
+	}
+}
+
+func errorResponse(id json.RawMessage, err *ErrorObject) Error {
+	return Error{JSONRPC: Version, ID: id, Error: err}
+}
+
+// validID reports whether id is absent, a string, a number or null.
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	default:
+		return false
+	}
+}
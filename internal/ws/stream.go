@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// sseKeepAlive is an SSE comment sent to streams in place of a ping.
+var sseKeepAlive = []byte(":\n\n")
+
+// sseEvent encodes msg as a server-sent event named after its method. id is
+// left out when zero.
+func sseEvent(id int64, msg Notification) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if id > 0 {
+		buf.WriteString("id: ")
+		buf.WriteString(strconv.FormatInt(id, 10))
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("event: ")
+	buf.WriteString(msg.Method)
+	buf.WriteString("\ndata: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+
+	return buf.Bytes(), nil
+}
+
+// Stream registers a server-sent events stream of the given user as an Agent.
+// The agent joins rooms and then receives the stored events it missed since
+// lastEventID, before any new notice. Streams are write only: the hub
+// writes SSE-encoded events to w and never reads from it.
+func (m *Message) Stream(w io.WriteCloser, client Client, rooms []string, lastEventID int64) (*Agent, error) {
+	client.Stream = true
+
+	agent, err := m.Register(streamConn{w}, client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, room := range rooms {
+		if _, err := m.Join(agent, room); err != nil {
+			m.Remove(agent)
+			return nil, err
+		}
+	}
+
+	if lastEventID > 0 {
+		envs, err := m.models.Events.GetAfter(agent.userID, rooms, lastEventID)
+		if err != nil {
+			m.Remove(agent)
+			return nil, err
+		}
+
+		for _, env := range envs {
+			bts, err := sseEvent(env.ID, Notification{JSONRPC: Version, Method: env.Method, Params: env.Params})
+			if err != nil {
+				continue
+			}
+			if err := agent.writeRaw(bts); err != nil {
+				m.Remove(agent)
+				return nil, err
+			}
+			lastEventID = env.ID
+		}
+	}
+
+	agent.resume(lastEventID)
+
+	return agent, nil
+}
+
+// streamConn adapts a write-only stream to the agent connection.
+type streamConn struct {
+	io.WriteCloser
+}
+
+func (streamConn) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
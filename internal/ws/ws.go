@@ -2,38 +2,101 @@ package ws
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	ErrNotMember      = errors.New("not a member of the room")
 )
 
 type Object map[string]interface{}
 
-type Error struct {
-	ID    int    `json:"id"`
-	Error Object `json:"error"`
-}
+// Version is the JSON-RPC version spoken over the socket.
+const Version = "2.0"
+
+// Standard JSON-RPC 2.0 error codes, followed by the application codes used
+// by the chat methods.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	CodeNotFound  = -32001
+	CodeNotMember = -32002
+	CodeForbidden = -32003
+	CodeConflict  = -32004
 
+	CodeRateLimited = -32005
+	CodeRejected    = -32006
+)
+
+// Request is a JSON-RPC request sent by a client. A request without an id is
+// a notification and gets no response.
 type Request struct {
-	ID     int    `json:"id"`
-	Method string `json:"method"`
-	Params Object `json:"params"`
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Notification is a JSON-RPC notification sent by the server.
+type Notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  Object `json:"params,omitempty"`
 }
 
 type Response struct {
-	ID     int    `json:"id"`
-	Result Object `json:"result"`
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+type Error struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *ErrorObject    `json:"error"`
+}
+
+// ErrorObject is the error member of a JSON-RPC error response. Data holds
+// the failed validation checks for CodeInvalidParams.
+type ErrorObject struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *ErrorObject) Error() string {
+	return e.Message
 }
 
 type Ws struct {
-	Agents AgentModel
+	Agents        AgentModel
+	Messages      MessageModel
+	Conversations ConversationModel
+	Presences     PresenceModel
+	Receipts      ReceiptModel
+	Events        EventModel
+	Blocks        BlockModel
+	Reports       ReportModel
+	Bans          BanModel
 }
 
 func NewWs(db *sql.DB) Ws {
 	return Ws{
-		Agents: AgentModel{DB: db},
+		Agents:        AgentModel{DB: db},
+		Messages:      MessageModel{DB: db},
+		Conversations: ConversationModel{DB: db},
+		Presences:     PresenceModel{DB: db},
+		Receipts:      ReceiptModel{DB: db},
+		Events:        EventModel{DB: db},
+		Blocks:        BlockModel{DB: db},
+		Reports:       ReportModel{DB: db},
+		Bans:          BanModel{DB: db},
 	}
 }
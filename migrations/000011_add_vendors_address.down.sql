@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS addresses_lat_lng_idx;
+DROP INDEX IF EXISTS vendors_address_id_idx;
+
+ALTER TABLE vendors DROP COLUMN IF EXISTS address_id;
@@ -0,0 +1,4 @@
+ALTER TABLE vendors ADD COLUMN IF NOT EXISTS address_id text REFERENCES addresses ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS vendors_address_id_idx ON vendors (address_id);
+CREATE INDEX IF NOT EXISTS addresses_lat_lng_idx ON addresses (lat, lng);
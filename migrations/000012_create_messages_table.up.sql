@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS messages
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    author     text                        NOT NULL,
+    params     jsonb                       NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE SET NULL;
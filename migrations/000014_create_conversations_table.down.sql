@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS messages_conversation_id_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS conversation_id;
+
+DROP TABLE IF EXISTS conversations;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS conversations
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    user1_id   bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    user2_id   bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    CONSTRAINT conversations_users_order_check CHECK (user1_id < user2_id),
+    CONSTRAINT conversations_users_key UNIQUE (user1_id, user2_id)
+);
+
+CREATE INDEX IF NOT EXISTS conversations_user2_id_idx ON conversations (user2_id);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS conversation_id bigint REFERENCES conversations ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS messages_conversation_id_idx ON messages (conversation_id, id);
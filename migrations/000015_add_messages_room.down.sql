@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS messages_room_idx;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS room;
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS room text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS messages_room_idx ON messages (room, id);
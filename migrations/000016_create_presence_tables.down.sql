@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS message_reads;
+DROP TABLE IF EXISTS presences;
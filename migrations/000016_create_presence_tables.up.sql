@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS presences
+(
+    user_id      bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    status       text                        NOT NULL,
+    last_seen_at timestamp(3) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS message_reads
+(
+    message_id bigint                      NOT NULL REFERENCES messages ON DELETE CASCADE,
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    read_at    timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id)
+);
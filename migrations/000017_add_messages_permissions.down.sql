@@ -0,0 +1 @@
+DELETE FROM permissions WHERE code IN ('messages:read', 'messages:write');
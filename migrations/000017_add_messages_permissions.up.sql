@@ -0,0 +1,11 @@
+INSERT INTO permissions (code)
+VALUES ('messages:read'),
+       ('messages:write');
+
+-- Existing users could already chat, so grant them both permissions.
+INSERT INTO users_permissions
+SELECT users.id, permissions.id
+FROM users,
+     permissions
+WHERE permissions.code IN ('messages:read', 'messages:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS events
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    room       text                        NOT NULL DEFAULT '',
+    user_ids   bigint[],
+    method     text                        NOT NULL,
+    params     jsonb                       NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at);
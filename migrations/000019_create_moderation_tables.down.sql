@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'messages:moderate';
+DROP TABLE IF EXISTS chat_bans;
+DROP TABLE IF EXISTS reports;
+DROP TABLE IF EXISTS user_blocks;
@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS user_blocks
+(
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    blocked_id bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, blocked_id)
+);
+
+CREATE TABLE IF NOT EXISTS reports
+(
+    id          bigserial PRIMARY KEY,
+    created_at  timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    reporter_id bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    user_id     bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    message_id  bigint REFERENCES messages ON DELETE SET NULL,
+    reason      text                        NOT NULL,
+    status      text                        NOT NULL DEFAULT 'open',
+    resolved_at timestamp(3) with time zone,
+    resolved_by bigint REFERENCES users ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS reports_status_idx ON reports (status, id);
+
+CREATE TABLE IF NOT EXISTS chat_bans
+(
+    user_id    bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    banned_by  bigint REFERENCES users ON DELETE SET NULL,
+    reason     text                        NOT NULL,
+    expires_at timestamp(3) with time zone
+);
+
+INSERT INTO permissions (code)
+VALUES ('messages:moderate');
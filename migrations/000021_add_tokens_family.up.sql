@@ -0,0 +1,6 @@
+CREATE SEQUENCE IF NOT EXISTS token_families;
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family bigint;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           bigint PRIMARY KEY          DEFAULT nextval('token_families'),
+    user_id      bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    ip           text                        NOT NULL DEFAULT '',
+    user_agent   text                        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+INSERT INTO sessions (id, user_id)
+SELECT DISTINCT family, user_id
+FROM tokens
+WHERE family IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE tokens
+    ADD CONSTRAINT tokens_family_fkey FOREIGN KEY (family) REFERENCES sessions ON DELETE CASCADE;
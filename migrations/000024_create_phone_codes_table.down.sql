@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS phone_codes;
+
+ALTER TABLE users DROP COLUMN IF EXISTS phone_verified_at;
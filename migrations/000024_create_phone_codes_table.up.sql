@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_verified_at timestamp(0) with time zone;
+
+CREATE TABLE IF NOT EXISTS phone_codes
+(
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    purpose    text                        NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    phone      text                        NOT NULL,
+    hash       bytea                       NOT NULL,
+    expiry     timestamp(0) with time zone NOT NULL,
+    attempts   integer                     NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, purpose)
+);
@@ -0,0 +1,17 @@
+-- Give the permissions granted through roles back as direct grants.
+INSERT INTO users_permissions
+SELECT DISTINCT users_roles.user_id, roles_permissions.permission_id
+FROM users_roles
+         INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+         INNER JOIN permissions ON permissions.id = roles_permissions.permission_id
+WHERE permissions.code IN ('vendors:read', 'vendors:write', 'messages:read', 'messages:write', 'messages:moderate')
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+
+DELETE
+FROM permissions
+WHERE code IN ('addresses:read', 'addresses:write', 'contents:read', 'contents:write', 'maps:write',
+               'users:read', 'users:manage');
@@ -0,0 +1,75 @@
+CREATE TABLE IF NOT EXISTS roles
+(
+    id   bigserial PRIMARY KEY,
+    code text UNIQUE NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions
+(
+    role_id       bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles
+(
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id    bigint                      NOT NULL REFERENCES roles ON DELETE CASCADE,
+    granted_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    granted_by bigint REFERENCES users ON DELETE SET NULL,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO permissions (code)
+VALUES ('addresses:read'),
+       ('addresses:write'),
+       ('contents:read'),
+       ('contents:write'),
+       ('maps:write'),
+       ('users:read'),
+       ('users:manage');
+
+INSERT INTO roles (code)
+VALUES ('customer'),
+       ('vendor'),
+       ('moderator'),
+       ('admin');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles,
+     permissions
+WHERE (roles.code = 'customer' AND permissions.code IN
+                                   ('vendors:read', 'addresses:read', 'messages:read', 'messages:write'))
+   OR (roles.code = 'vendor' AND permissions.code IN
+                                 ('vendors:read', 'vendors:write', 'addresses:read', 'addresses:write',
+                                  'contents:read', 'contents:write', 'maps:write', 'messages:read',
+                                  'messages:write'))
+   OR (roles.code = 'moderator' AND permissions.code IN
+                                    ('vendors:read', 'addresses:read', 'messages:read', 'messages:write',
+                                     'messages:moderate', 'users:read'))
+   OR roles.code = 'admin';
+
+-- Existing users get the roles matching the permissions they were granted,
+-- then lose the direct grants those roles now cover.
+INSERT INTO users_roles (user_id, role_id)
+SELECT users.id, roles.id
+FROM users,
+     roles
+WHERE roles.code = 'customer'
+ON CONFLICT DO NOTHING;
+
+INSERT INTO users_roles (user_id, role_id)
+SELECT DISTINCT users_permissions.user_id, roles.id
+FROM users_permissions
+         INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+         INNER JOIN roles ON (roles.code = 'vendor' AND permissions.code = 'vendors:write')
+    OR (roles.code = 'moderator' AND permissions.code = 'messages:moderate')
+ON CONFLICT DO NOTHING;
+
+DELETE
+FROM users_permissions
+    USING users_roles, roles_permissions
+WHERE users_roles.user_id = users_permissions.user_id
+  AND roles_permissions.role_id = users_roles.role_id
+  AND roles_permissions.permission_id = users_permissions.permission_id;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS two_factor
+(
+    user_id      bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    secret       text                        NOT NULL,
+    confirmed_at timestamp(0) with time zone,
+    last_step    bigint                      NOT NULL DEFAULT 0,
+    attempts     integer                     NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes
+(
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash    bytea  NOT NULL,
+    PRIMARY KEY (user_id, hash)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS auth_attempts
+(
+    key            text PRIMARY KEY,
+    failures       integer                     NOT NULL DEFAULT 0,
+    last_failed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until   timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS auth_attempts_last_failed_at_idx ON auth_attempts (last_failed_at);
@@ -0,0 +1,19 @@
+DROP INDEX IF EXISTS users_phone_key;
+
+-- Unverified numbers may be shared, so keep each number only on the user who
+-- verified it, or else on the first user who entered it.
+UPDATE users SET phone = NULL, phone_verified_at = NULL
+WHERE id IN (
+    SELECT id
+    FROM (
+        SELECT id, ROW_NUMBER() OVER (
+            PARTITION BY phone
+            ORDER BY (phone_verified_at IS NOT NULL AND deleted_at IS NULL) DESC, id
+        ) AS n
+        FROM users
+        WHERE phone IS NOT NULL
+    ) ranked
+    WHERE n > 1
+);
+
+ALTER TABLE users ADD CONSTRAINT users_phone_key UNIQUE (phone);
@@ -0,0 +1,7 @@
+-- A phone number belongs to the user who verified it last, so only verified
+-- numbers of users that were not deleted need to be unique.
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_phone_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_phone_key ON users (phone) WHERE phone_verified_at IS NOT NULL AND deleted_at IS NULL;
+
+-- Deleted users give up their email address, so it can be registered again.
+UPDATE users SET email = 'deleted-' || id || '@deleted.invalid' WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS vendors_user_id_idx;
+
+ALTER TABLE vendors DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,3 @@
+ALTER TABLE vendors ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS vendors_user_id_idx ON vendors (user_id);
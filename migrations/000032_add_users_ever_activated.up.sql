@@ -0,0 +1,6 @@
+-- Only accounts that were never activated may be reclaimed by the owner of
+-- their email address. Email changes used to deactivate accounts, so the
+-- ones that were edited since they were registered count as activated too.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS ever_activated boolean NOT NULL DEFAULT false;
+
+UPDATE users SET ever_activated = true WHERE activated OR version > 1;